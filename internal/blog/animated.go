@@ -0,0 +1,232 @@
+package blog
+
+import (
+	// internal
+	"blog/internal/media"
+
+	// golang
+	"bytes"
+	"database/sql"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/gif"
+	"log"
+
+	// externals
+	"golang.org/x/image/webp"
+)
+
+// isAnimated reports whether a gif has more than one frame, or a webp has the animation flag set
+func isAnimated(file_bytes []byte) bool {
+	switch {
+	case bytes.HasPrefix(file_bytes, []byte("GIF8")):
+		return gifFrames(file_bytes, 2) > 1
+	case isWebP(file_bytes):
+		return len(file_bytes) >= 21 && string(file_bytes[12:16]) == "VP8X" && file_bytes[20]&0x02 != 0
+	}
+	return false
+}
+
+func isWebP(b []byte) bool {
+	return len(b) >= 12 && string(b[0:4]) == "RIFF" && string(b[8:12]) == "WEBP"
+}
+
+// gifFrames counts the image descriptors in a gif without decoding them, up to max
+func gifFrames(b []byte, max int) int {
+	if len(b) < 13 {
+		return 0
+	}
+	i := 13
+	if b[10]&0x80 != 0 { // global color table
+		i += 3 << (b[10]&0x07 + 1)
+	}
+
+	skipSubBlocks := func() {
+		for i < len(b) {
+			n := int(b[i])
+			i += 1 + n
+			if n == 0 {
+				return
+			}
+		}
+	}
+
+	frames := 0
+	for i < len(b) && frames < max {
+		switch b[i] {
+		case 0x21: // extension: label, then data sub-blocks
+			i += 2
+			skipSubBlocks()
+		case 0x2c: // image descriptor
+			frames++
+			if i+10 > len(b) {
+				return frames
+			}
+			flags := b[i+9]
+			i += 10
+			if flags&0x80 != 0 { // local color table
+				i += 3 << (flags&0x07 + 1)
+			}
+			i++ // LZW minimum code size
+			skipSubBlocks()
+		default: // trailer
+			return frames
+		}
+	}
+	return frames
+}
+
+// riffChunks calls fn with each chunk (header and padding included) and its payload
+// until fn returns false
+func riffChunks(b []byte, fn func(id string, chunk, payload []byte) bool) {
+	for i := 0; i+8 <= len(b); {
+		size := int(binary.LittleEndian.Uint32(b[i+4:]))
+		padded := 8 + size + size&1 // chunks are padded to an even size
+		if !fn(string(b[i:i+4]), b[i:min(i+padded, len(b))], b[i+8:min(i+8+size, len(b))]) {
+			return
+		}
+		i += padded
+	}
+}
+
+// webpFirstFrame rebuilds the first ANMF frame of an animated webp as a still webp,
+// the decoder doesn't support animations
+func webpFirstFrame(file_bytes []byte) (image.Image, image.Point, error) {
+	var frame []byte
+	riffChunks(file_bytes[12:], func(id string, chunk, payload []byte) bool {
+		if id == "ANMF" && len(payload) > 16 {
+			frame = payload
+			return false
+		}
+		return true
+	})
+	if frame == nil {
+		return nil, image.Point{}, fmt.Errorf("no frames found in animated webp")
+	}
+
+	u24 := func(b []byte) int { return int(b[0]) | int(b[1])<<8 | int(b[2])<<16 }
+	offset := image.Pt(u24(frame[0:])*2, u24(frame[3:])*2)
+
+	var alpha, bitstream []byte
+	riffChunks(frame[16:], func(id string, chunk, payload []byte) bool {
+		switch id {
+		case "ALPH":
+			alpha = chunk
+		case "VP8 ", "VP8L":
+			bitstream = chunk
+			return false
+		}
+		return true
+	})
+	if bitstream == nil {
+		return nil, image.Point{}, fmt.Errorf("first webp frame has no image data")
+	}
+
+	body := []byte("WEBP")
+	if alpha != nil {
+		// lossy frames keep their alpha in a separate chunk, which needs a VP8X header
+		vp8x := make([]byte, 18)
+		copy(vp8x, "VP8X")
+		binary.LittleEndian.PutUint32(vp8x[4:], 10)
+		vp8x[8] = 0x10 // alpha
+		copy(vp8x[12:], frame[6:12])
+		body = append(append(body, vp8x...), alpha...)
+	}
+	body = append(body, bitstream...)
+
+	still := binary.LittleEndian.AppendUint32([]byte("RIFF"), uint32(len(body)))
+	still = append(still, body...)
+
+	img, err := webp.Decode(bytes.NewReader(still))
+	return img, offset, err
+}
+
+// decodeFirstFrame decodes the first frame of an animated gif/webp onto its full canvas
+func decodeFirstFrame(file_bytes []byte) (image.Image, error) {
+	var frame image.Image
+	var offset image.Point
+	var canvas image.Config
+	var err error
+
+	if isWebP(file_bytes) {
+		canvas, err = webp.DecodeConfig(bytes.NewReader(file_bytes))
+		if err != nil {
+			return nil, err
+		}
+		frame, offset, err = webpFirstFrame(file_bytes)
+	} else {
+		canvas, err = gif.DecodeConfig(bytes.NewReader(file_bytes))
+		if err != nil {
+			return nil, err
+		}
+		frame, err = gif.Decode(bytes.NewReader(file_bytes)) // gif frames carry their own offset
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	dst := image.NewNRGBA(image.Rect(0, 0, canvas.Width, canvas.Height))
+	draw.Draw(dst, frame.Bounds().Add(offset), frame, frame.Bounds().Min, draw.Src)
+	return dst, nil
+}
+
+// AnimatedImages lists the gif/webp page images that are animated, for BackfillAnimated.
+// files that can't be read are logged and skipped rather than failing the migration
+func AnimatedImages(db *sql.DB, ms *media.Store) ([]string, error) {
+	rows, err := db.Query(`
+		SELECT DISTINCT i.media_hash FROM page_images i
+		JOIN media m ON m.hash = i.media_hash
+		WHERE m.mime_type IN ('image/gif', 'image/webp')`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get gif/webp images: %w", err)
+	}
+
+	var hashes []string
+	for rows.Next() {
+		var hash string
+		if err := rows.Scan(&hash); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan image: %w", err)
+		}
+		hashes = append(hashes, hash)
+	}
+	rows.Close()
+
+	var animated []string
+	for _, hash := range hashes {
+		file_bytes, err := ms.ReadAll(hash)
+		if err != nil {
+			log.Printf("skipping image %v, could not read it: %v", hash, err)
+			continue
+		}
+		if isAnimated(file_bytes) {
+			animated = append(animated, hash)
+		}
+	}
+	return animated, nil
+}
+
+// BackfillAnimated flags animated gif/webp page images uploaded before they were
+// supported, and drops the still width variants that were generated for them
+func BackfillAnimated(tx *sql.Tx, animated []string) error {
+	for _, hash := range animated {
+		_, err := tx.Exec("UPDATE page_images SET animated = 1 WHERE media_hash = ?", hash)
+		if err != nil {
+			return fmt.Errorf("failed to flag image %v: %w", hash, err)
+		}
+		_, err = tx.Exec("DELETE FROM page_image_variants WHERE source_hash = ? AND kind = ?", hash, VARIANT_WIDTH)
+		if err != nil {
+			return fmt.Errorf("failed to remove still variants of %v: %w", hash, err)
+		}
+	}
+
+	_, err := tx.Exec(`
+		UPDATE pages
+		SET animated = EXISTS (SELECT 1 FROM page_images WHERE page_id = pages.id AND animated = 1)`)
+	if err != nil {
+		return fmt.Errorf("failed to flag animated pages: %w", err)
+	}
+	return nil
+}
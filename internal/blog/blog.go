@@ -2,13 +2,12 @@ package blog
 
 import (
 	// internal
+	"blog/internal/jobs"
+	"blog/internal/media"
 	"blog/internal/users"
-	"bytes"
-	"encoding/base64"
-	"image"
 	_ "image/jpeg"
 	_ "image/png"
-	"io"
+	"sort"
 	"strconv"
 	"strings"
 
@@ -24,7 +23,6 @@ import (
 	"time"
 
 	// externals
-	"github.com/disintegration/imaging"
 	"github.com/gorilla/sessions"
 )
 
@@ -32,16 +30,23 @@ type BlogPage struct {
 	ID       int64
 	Title    string
 	DisplayTitle string
-	Content  string // TODO: might want to make this markdown compatible
+	Content  string // markdown
+	ContentHTML template.HTML // rendered and sanitized Content, only set for page views
 	PostTime time.Time
-	Image    string // TODO: consider changing this back to a blob/save in a subfolder to serve
-	Thumbnail string
+	Image    string // sha256 hash of the cover image in the media store, served at /media/{hash}
+	Thumbnail string // sha256 hash of the cover thumbnail
+	Images   []PageImage // gallery, the first image is the cover
+	Animated bool // has an animated gif/webp, badged on the home page
+	Videos   []PageVideo
 	Tags     []Tag
 	Comments []Comment
 	Uploader string
 	Views int64
 	LinkPost bool
 	UrlLink string
+	Unlisted bool // left out of listings, only reachable by direct link
+	Level string // access level, users.PUBLIC_LEVEL or a subscription level
+	Status string // PAGE_DRAFT or PAGE_PUBLISHED
 }
 
 type Comment struct {
@@ -56,6 +61,11 @@ type Tag struct {
 	ID       int64
 	Name     string
 	Selected bool
+	Description string
+	Aliases  []string // only set for tag management
+	PageCount int // only set for tag management
+	ParentID int64 // 0 for a top level tag
+	Children []Tag // only set for the tag tree
 }
 
 const (
@@ -137,13 +147,16 @@ func HomePage(w http.ResponseWriter, r *http.Request, db *sql.DB, st *sessions.C
 		return
 	}
 
-	selectedTag := r.URL.Query().Get("tag")
+	filter := parseTagFilter(db, r.URL.Query())
+	selectedTag := filter.Single()
+	show_hidden := canSeeHidden(r, st)
 
 	var rows *sql.Rows
 	var err error
-	if selectedTag == "" {
+	if filter.Empty() {
 		query := `
-			SELECT id, title, display_title, post_time, thumbnail, uploader FROM pages
+			SELECT id, title, display_title, post_time, thumbnail, uploader, animated, IFNULL(unlisted, 0), level FROM pages
+			WHERE ` + visibleFilter("", show_hidden) + `
 			ORDER BY post_time DESC
 		`
 		rows, err = db.Query(query)
@@ -152,18 +165,17 @@ func HomePage(w http.ResponseWriter, r *http.Request, db *sql.DB, st *sessions.C
 			return
 		}
 	} else {
+		tags, args := filter.where("p")
 		query := `
-			SELECT DISTINCT p.id, p.title, p.display_title, p.post_time, p.thumbnail, p.uploader
+			SELECT p.id, p.title, p.display_title, p.post_time, p.thumbnail, p.uploader, p.animated, IFNULL(p.unlisted, 0), p.level
 			FROM pages p
-			JOIN page_tags pt ON p.id = pt.page_id
-			JOIN tags t ON pt.tag_id = t.id
-			WHERE t.name = ?
+			WHERE ` + tags + ` AND ` + visibleFilter("p", show_hidden) + `
 			ORDER BY p.post_time DESC
 		`
 
-		rows, err = db.Query(query, selectedTag)
+		rows, err = db.Query(query, args...)
 		if err != nil {
-			log.Printf("failed to access rows with tag '%v': %v", selectedTag, err)
+			log.Printf("failed to access rows with tags %v: %v", filter.Values(), err)
 			RenderTemplate(w, r, "NotFound", nil, st)
 			return
 		}
@@ -174,7 +186,7 @@ func HomePage(w http.ResponseWriter, r *http.Request, db *sql.DB, st *sessions.C
 
 	for rows.Next() {
 		var p BlogPage
-		err := rows.Scan(&p.ID, &p.Title, &p.DisplayTitle, &p.PostTime, &p.Thumbnail, &p.Uploader)
+		err := rows.Scan(&p.ID, &p.Title, &p.DisplayTitle, &p.PostTime, &p.Thumbnail, &p.Uploader, &p.Animated, &p.Unlisted, &p.Level)
 		if err != nil {
 			log.Printf("Failed to scan row: %v", err)
 			return
@@ -189,38 +201,40 @@ func HomePage(w http.ResponseWriter, r *http.Request, db *sql.DB, st *sessions.C
 		pages = append(pages, p)
 	}
 
-	// get all tags from DB for tag list
-	tag_rows, err := db.Query(
-		`SELECT name
-		FROM tags
-		ORDER BY name
-		`)
+	// get all tags from DB for tag list, tags only used by hidden pages stay hidden
+	tags, err := tagTree(db, show_hidden, filter.Include)
 	if err != nil {
 		log.Printf("failed to get all tags: %v", err)
 		return
 	}
-	defer tag_rows.Close()
 
-	tags := []Tag{}
-
-	for tag_rows.Next() {
-		var t Tag
-		err = tag_rows.Scan(&t.Name)
+	// a single selected tag with the tags above it, for the breadcrumbs
+	tag_path := []Tag{}
+	selected_description := ""
+	if selectedTag != "" {
+		tag_path, err = tagPath(db, selectedTag)
 		if err != nil {
-			log.Printf("failed to scan row for tag: %v", err)
-			return
+			log.Printf("error getting path of tag '%v': %v", selectedTag, err)
+		}
+		if len(tag_path) > 0 {
+			selected_description = tag_path[len(tag_path)-1].Description
 		}
-		tags = append(tags, t)
 	}
 
 	data := struct {
 		Pages       []BlogPage
 		Tags        []Tag
 		SelectedTag string
+		SelectedTagDescription string
+		TagPath     []Tag
+		Filter      TagFilter
 	}{
 		Pages:       pages,
 		Tags:        tags,
 		SelectedTag: selectedTag,
+		SelectedTagDescription: selected_description,
+		TagPath:     tag_path,
+		Filter:      filter,
 	}
 
 	RenderTemplate(w, r, "Home", data, st)
@@ -240,52 +254,180 @@ func UploaderPage(w http.ResponseWriter, r *http.Request, st *sessions.CookieSto
 	RenderTemplate(w, r, title, nil, st)
 }
 
-func UploadPage(w http.ResponseWriter, r *http.Request, st *sessions.CookieStore) {
+func UploadPage(w http.ResponseWriter, r *http.Request, db *sql.DB, st *sessions.CookieStore) {
 	if !users.IsUploader(r, st) {
 		log.Printf("non uploader attempted to access accounts page handler from: %v", r.Host)
 		RenderTemplate(w, r, "NotFound", nil, st)
 		return
 	}
-	RenderTemplate(w, r, "Upload", nil, st)
+
+	levels, err := users.GetSubscriptionLevels(db)
+	if err != nil {
+		log.Printf("error getting subscription levels: %v", err)
+	}
+
+	series, err := getAllSeries(db)
+	if err != nil {
+		log.Printf("error getting series: %v", err)
+	}
+
+	data := map[string]interface{}{
+		"Levels": levels,
+		"Series": series,
+	}
+	RenderTemplate(w, r, "Upload", data, st)
 }
 
-// returns true if page already exists
-func addPageToDB(db *sql.DB, title string, display_title string, content string, post_time time.Time, image64 string, thumbnail64 string, tags []string, uploader string, unlisted bool, link_post bool, url_link string) (error, bool) {
+// returns the page's id and the ids of the queued image jobs, and true if the custom slug
+// is already in use. if draftID is set that (autosaved) draft is filled in instead of
+// adding a new page
+func addPageToDB(db *sql.DB, q *jobs.Queue, draftID int64, status string, custom_slug string, display_title string, content string, post_time time.Time, images []storedImage, video *storedVideo, tags []string, uploader string, unlisted bool, link_post bool, url_link string, level string, seriesID int64) (int64, []int64, error, bool) {
 	// Start a transaction since we'll be doing multiple operations
 	tx, err := db.Begin()
 	if err != nil {
-		return fmt.Errorf("failed to begin transaction: %w", err), false
+		return 0, nil, fmt.Errorf("failed to begin transaction: %w", err), false
 	}
 	defer tx.Rollback() // Will rollback if we don't commit
 
-	// Check if page exists
-	var exists bool
-	err = tx.QueryRow("SELECT EXISTS(SELECT 1 FROM pages WHERE title = ?)", title).Scan(&exists)
+	pageID := draftID
+	if draftID != 0 {
+		var draft_uploader, draft_status string
+		err = tx.QueryRow("SELECT uploader, status FROM pages WHERE id = ?", draftID).Scan(&draft_uploader, &draft_status)
+		if err != nil || draft_uploader != uploader || draft_status != PAGE_DRAFT {
+			return 0, nil, fmt.Errorf("draft %v not found for '%v'", draftID, uploader), false
+		}
+	}
+
+	// pick the slug, titles taken by another page get a numeric suffix
+	title, err := pageSlug(tx, custom_slug, display_title, draftID)
+	if err == errSlugTaken {
+		return 0, nil, fmt.Errorf("'%s' already exists in db", custom_slug), true
+	}
 	if err != nil {
-		return fmt.Errorf("failed to check if row exists: %w", err), false
+		return 0, nil, err, false
+	}
+
+	if draftID != 0 {
+		_, err = tx.Exec(`
+			UPDATE pages
+			SET title = ?, display_title = ?, content = ?, content_html = '', post_time = ?,
+				unlisted = ?, link_post = ?, url_link = ?, level = ?, status = ?, saved_at = CURRENT_TIMESTAMP
+			WHERE id = ?`,
+			title, display_title, content, post_time, unlisted, link_post, url_link, level, status, draftID)
+		if err != nil {
+			return 0, nil, fmt.Errorf("failed to update draft: %w", err), false
+		}
+	} else {
+		// Insert the page and get its ID
+		// image/thumbnail are set by syncCoverImage once the images are in
+		result, err := tx.Exec("INSERT INTO pages (title, display_title, content, post_time, image, thumbnail, uploader, unlisted, link_post, url_link, level, status, saved_at) VALUES (?, ?, ?, ?, '', '', ?, ?, ?, ?, ?, ?, CURRENT_TIMESTAMP)",
+			title, display_title, content, post_time, uploader, unlisted, link_post, url_link, level, status)
+		if err != nil {
+			return 0, nil, fmt.Errorf("failed to add to database: %w", err), false
+		}
+
+		pageID, err = result.LastInsertId()
+		if err != nil {
+			return 0, nil, fmt.Errorf("failed to get last insert id: %w", err), false
+		}
+
+		// titles without letters or numbers get a slug from the id
+		if title == "" {
+			title, err = uniqueSlug(tx, idSlug(pageID), pageID)
+			if err != nil {
+				return 0, nil, err, false
+			}
+			_, err = tx.Exec("UPDATE pages SET title = ? WHERE id = ?", title, pageID)
+			if err != nil {
+				return 0, nil, fmt.Errorf("failed to set slug: %w", err), false
+			}
+		}
 	}
-	if exists {
-		return fmt.Errorf("'%s' already exists in db", title), true
+
+	err = addPageImages(tx, pageID, images, display_title)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to add images: %w", err), false
 	}
 
-	// Insert the page and get its ID
-	result, err := tx.Exec("INSERT INTO pages (title, display_title, content, post_time, image, thumbnail, uploader, unlisted, link_post, url_link) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
-		title, display_title, content, post_time, image64, thumbnail64, uploader, unlisted, link_post, url_link)
+	// thumbnails and resized variants are made in the background
+	job_ids, err := enqueueImageJobs(tx, q, pageID, images, uploader)
 	if err != nil {
-		return fmt.Errorf("failed to add to database: %w", err), false
+		return 0, nil, err, false
+	}
+
+	if video != nil {
+		videoID, err := addPageVideo(tx, pageID, video)
+		if err != nil {
+			return 0, nil, err, false
+		}
+		if video.Poster != nil {
+			id, err := q.EnqueueTx(tx, JOB_POSTER_THUMBNAIL, posterJob{VideoID: videoID}, uploader)
+			if err != nil {
+				return 0, nil, err, false
+			}
+			job_ids = append(job_ids, id)
+		}
 	}
 
-	pageID, err := result.LastInsertId()
+	err = syncCoverImage(tx, pageID)
 	if err != nil {
-		return fmt.Errorf("failed to get last insert id: %w", err), false
+		return 0, nil, err, false
+	}
+
+	// drafts can be saved before any media is added
+	if status == PAGE_PUBLISHED {
+		has_media, err := hasMedia(tx, pageID)
+		if err != nil {
+			return 0, nil, err, false
+		}
+		if !has_media {
+			return 0, nil, errNoMedia, false
+		}
 	}
 
 	// Add tags
+	err = setPageTags(tx, pageID, tags)
+	if err != nil {
+		return 0, nil, err, false
+	}
+
+	err = setPageSeries(tx, pageID, seriesID)
+	if err != nil {
+		return 0, nil, err, false
+	}
+
+	err = saveRevision(tx, pageID, uploader)
+	if err != nil {
+		return 0, nil, err, false
+	}
+
+	// Commit the transaction
+	if err = tx.Commit(); err != nil {
+		return 0, nil, fmt.Errorf("failed to commit transaction: %w", err), false
+	}
+
+	return pageID, job_ids, nil, false
+}
+
+// setPageTags replaces the tags of a page (normalized by parseTags), creating new tags and
+// removing ones no page uses anymore
+func setPageTags(tx *sql.Tx, pageID int64, tags []string) error {
+	_, err := tx.Exec("DELETE FROM page_tags WHERE page_id = ?", pageID)
+	if err != nil {
+		return fmt.Errorf("failed to clear tags: %w", err)
+	}
+
 	for _, tagName := range tags {
 		if tagName == "" {
 			continue // Skip empty tags
 		}
 
+		// aliases are saved as the tag they stand for
+		tagName, err = resolveTag(tx, tagName)
+		if err != nil {
+			return err
+		}
+
 		// Insert tag if it doesn't exist and get its ID
 		var tagID int64
 		err = tx.QueryRow(`
@@ -294,58 +436,36 @@ func addPageToDB(db *sql.DB, title string, display_title string, content string,
             ON CONFLICT(name) DO UPDATE SET name=name 
             RETURNING id`, tagName).Scan(&tagID)
 		if err != nil {
-			return fmt.Errorf("failed to insert/get tag '%s': %w", tagName, err), false
+			return fmt.Errorf("failed to insert/get tag '%s': %w", tagName, err)
 		}
 
-		// Link tag to page
+		// Link tag to page, repeated tags are linked once
 		_, err = tx.Exec(`
             INSERT INTO page_tags (page_id, tag_id) 
-            VALUES (?, ?)`, pageID, tagID)
+            SELECT ?, ?
+            WHERE NOT EXISTS (SELECT 1 FROM page_tags WHERE page_id = ? AND tag_id = ?)`, pageID, tagID, pageID, tagID)
 		if err != nil {
-			return fmt.Errorf("failed to link tag '%s' to page: %w", tagName, err), false
+			return fmt.Errorf("failed to link tag '%s' to page: %w", tagName, err)
 		}
 	}
 
-	// Commit the transaction
-	if err = tx.Commit(); err != nil {
-		return fmt.Errorf("failed to commit transaction: %w", err), false
+	// Clean up unused tags
+	err = cleanUpTags(tx)
+	if err != nil {
+		return fmt.Errorf("failed to clean up tags: %w", err)
 	}
-
-	return nil, false
-}
-
-func sanitizeTitle(title string) string {
-    var result strings.Builder
-    
-    lastWasHyphen := false
-    
-    for _, char := range title {
-        switch {
-        case (char >= 'a' && char <= 'z') || (char >= 'A' && char <= 'Z') || (char >= '0' && char <= '9'):
-            result.WriteRune(char)
-            lastWasHyphen = false
-        case char == ' ':
-            if !lastWasHyphen {
-                result.WriteRune('-')
-                lastWasHyphen = true
-            }
-        }
-    }
-    
-    sanitized := strings.TrimSuffix(result.String(), "-")
-    
-    return sanitized
+	return nil
 }
 
-func UploadHandler(w http.ResponseWriter, r *http.Request, db *sql.DB, st *sessions.CookieStore) {
+func UploadHandler(w http.ResponseWriter, r *http.Request, db *sql.DB, st *sessions.CookieStore, ms *media.Store, q *jobs.Queue) {
 	if !users.IsUploader(r, st) {
 		w.Write([]byte("Unauthorized access"))
 		return
 	}
 
-	err := r.ParseMultipartForm(MAX_UPLOAD_SIZE)
+	err := parseUploadForm(w, r, st)
 	if err != nil {
-		w.Write([]byte("Invalid request - file may be too large"))
+		writeUploadError(w, err)
 		return
 	}
 
@@ -355,11 +475,15 @@ func UploadHandler(w http.ResponseWriter, r *http.Request, db *sql.DB, st *sessi
 		return
 	}
 
-	title := sanitizeTitle(display_title)
+	// made from the title if not given
+	custom_slug := r.FormValue("slug")
 
-	tags_string := r.FormValue("tags")
 	// parse tags string into tags list
-	tags := strings.Fields(strings.ReplaceAll(tags_string, ",", " "))
+	tags, err := parseTags(r.FormValue("tags"))
+	if err != nil {
+		w.Write([]byte(err.Error()))
+		return
+	}
 
 	uploader_name, err := users.GetCurrentUsername(r, st); if err != nil {
 		w.Write([]byte("Error getting username from session"))
@@ -374,6 +498,12 @@ func UploadHandler(w http.ResponseWriter, r *http.Request, db *sql.DB, st *sessi
 	link_post := r.FormValue("link_post") == "on" 
 	url_link := r.FormValue("url_link")
 
+	level, ok := formLevel(r, db, users.PUBLIC_LEVEL)
+	if !ok {
+		w.Write([]byte("Unknown access level"))
+		return
+	}
+
     post_time_str := r.FormValue("post_time")
     var post_time time.Time
     if post_time_str != "" {
@@ -387,41 +517,31 @@ func UploadHandler(w http.ResponseWriter, r *http.Request, db *sql.DB, st *sessi
         post_time = time.Now() // Default to current time if none specified
     }
 
-	file, _, err := r.FormFile("image")
-	if err != nil {
-		w.Write([]byte("No image found"))
-		return
-	}
-	defer file.Close()
-
-	file_bytes, err := io.ReadAll(file)
+	images, err := readImageUploads(r, ms, "images", parseFocus(r.FormValue("focus"), "", ""))
 	if err != nil {
-		w.Write([]byte("Error reading file"))
-		return
-	}
-
-	file64 := base64.StdEncoding.EncodeToString(file_bytes)
-
-	// make thumbnail image64
-	thumb, _, err := image.Decode(bytes.NewReader(file_bytes)); if err != nil {
-		w.Write([]byte("Error decoding image for thumbnail"))
+		writeUploadError(w, err)
 		return
 	}
-
-	thumb = imaging.Fill(thumb, 300, 300, imaging.Top, imaging.Lanczos)
-	var buf bytes.Buffer
-	err = imaging.Encode(&buf, thumb, imaging.JPEG, imaging.JPEGQuality(80))
+	video, err := readVideoUpload(r, ms, "video", "poster")
 	if err != nil {
-		w.Write([]byte("Error encoding image for thumbnail"))
+		writeUploadError(w, err)
 		return
 	}
 
-	small64 := base64.StdEncoding.EncodeToString(buf.Bytes())
+	// set once the form has been autosaved
+	draftID, _ := strconv.ParseInt(r.FormValue("draft_id"), 10, 64)
+	status := pageStatus(r, PAGE_PUBLISHED)
 
-	err, exists := addPageToDB(db, title, display_title, content, post_time, file64, small64, tags, uploader_name, unlisted, link_post, url_link)
+	pageID, job_ids, err, exists := addPageToDB(db, q, draftID, status, custom_slug, display_title, content, post_time, images, video, tags, uploader_name, unlisted, link_post, url_link, level, formSeries(r))
 	if err != nil {
 		if exists {
-			w.Write([]byte("Title already in use"))
+			w.Write([]byte("Slug already in use"))
+		} else if err == errInvalidSlug {
+			w.Write([]byte("Invalid slug, " + err.Error()))
+		} else if err == errNoMedia {
+			http.Error(w, "No image or video found", http.StatusBadRequest)
+		} else if err == errUnknownSeries {
+			w.Write([]byte("Unknown series"))
 		} else {
 			w.Write([]byte("Error uploading to database"))
 			log.Printf("Error uploading to database: %v", err)
@@ -429,7 +549,17 @@ func UploadHandler(w http.ResponseWriter, r *http.Request, db *sql.DB, st *sessi
 		return
 	}
 
-	w.Write([]byte("Upload successful!"))
+	if video != nil && video.Poster != nil {
+		images = append(images, *video.Poster)
+	}
+	q.Wake()
+
+	// drafts carry on in the edit form, which knows about the images already added
+	if status == PAGE_DRAFT {
+		w.Header().Set("HX-Redirect", fmt.Sprintf("/edit-page/%d", pageID))
+		return
+	}
+	w.Write([]byte("Upload successful!" + metadataSummary(images) + jobs.PollingStatus(job_ids)))
 }
 
 func AccountsPageHandler(w http.ResponseWriter, r *http.Request, db *sql.DB, st *sessions.CookieStore) {
@@ -440,29 +570,38 @@ func AccountsPageHandler(w http.ResponseWriter, r *http.Request, db *sql.DB, st
 		return
 	}
 
-	users, err := users.GetUsers(db)
+	accounts, err := users.GetUsers(db)
 	if err != nil {
 		log.Printf("error getting users: %v", err)
 	}
 
-	RenderTemplate(w, r, "Accounts", users, st)
+	levels, err := users.GetSubscriptionLevels(db)
+	if err != nil {
+		log.Printf("error getting subscription levels: %v", err)
+	}
+
+	data := map[string]interface{}{
+		"Users":  accounts,
+		"Levels": levels,
+	}
+	RenderTemplate(w, r, "Accounts", data, st)
 }
 
-func EditPageHandler(w http.ResponseWriter, r *http.Request, db *sql.DB, st *sessions.CookieStore) {
+func EditPageHandler(w http.ResponseWriter, r *http.Request, db *sql.DB, st *sessions.CookieStore, ms *media.Store, q *jobs.Queue) {
     if !users.IsUploader(r, st) {
         w.Write([]byte("Unauthorized access"))
         return
     }
 
-    err := r.ParseMultipartForm(MAX_UPLOAD_SIZE)
+    err := parseUploadForm(w, r, st)
     if err != nil {
-        w.Write([]byte("Invalid request - file may be too large"))
+        writeUploadError(w, err)
         return
     }
 
-    original_title := r.FormValue("original_title")
-    if original_title == "" {
-        w.Write([]byte("Missing original title, error on backend"))
+    pageID, err := strconv.ParseInt(r.FormValue("page_id"), 10, 64)
+    if err != nil {
+        w.Write([]byte("Missing page id, error on backend"))
         return
     }
 
@@ -472,12 +611,18 @@ func EditPageHandler(w http.ResponseWriter, r *http.Request, db *sql.DB, st *ses
         return
     }
 
-    curr_pg, err := getPageFromDB(original_title, db)
+    curr_pg, err := getPageFromDB(pageID, db)
     if err != nil {
         w.Write([]byte("Error getting current page from database"))
         return
     }
 
+	tags, err := parseTags(r.FormValue("tags"))
+	if err != nil {
+		w.Write([]byte(err.Error()))
+		return
+	}
+
     requesting_uploader, err := users.GetCurrentUsername(r, st)
     if err != nil {
         w.Write([]byte("Unrecognized user"))
@@ -489,6 +634,19 @@ func EditPageHandler(w http.ResponseWriter, r *http.Request, db *sql.DB, st *ses
         return
     }
 
+	// store new images and video before the transaction holds the database
+	new_images, err := readImageUploads(r, ms, "images", parseFocus(r.FormValue("focus"), "", ""))
+	if err != nil {
+		writeUploadError(w, err)
+		return
+	}
+
+	new_video, err := readVideoUpload(r, ms, "video", "poster")
+	if err != nil {
+		writeUploadError(w, err)
+		return
+	}
+
     // Start transaction
     tx, err := db.Begin()
     if err != nil {
@@ -497,13 +655,7 @@ func EditPageHandler(w http.ResponseWriter, r *http.Request, db *sql.DB, st *ses
     }
     defer tx.Rollback()
 
-	// Get the current page ID
-	var pageID int64
-	err = tx.QueryRow("SELECT id FROM pages WHERE title = ?", curr_pg.Title).Scan(&pageID)
-	if err != nil {
-		w.Write([]byte("Error retrieving page ID"))
-		return
-	}
+	status := pageStatus(r, curr_pg.Status)
 
 	post_time_str := r.FormValue("post_time")
     var post_time time.Time
@@ -514,6 +666,8 @@ func EditPageHandler(w http.ResponseWriter, r *http.Request, db *sql.DB, st *ses
             w.Write([]byte("Invalid date format"))
             return
         }
+    } else if curr_pg.Status == PAGE_DRAFT && status == PAGE_PUBLISHED {
+        post_time = time.Now() // drafts are posted when published
     } else {
         post_time = curr_pg.PostTime  // Default to current page time if none specified
     }
@@ -522,26 +676,57 @@ func EditPageHandler(w http.ResponseWriter, r *http.Request, db *sql.DB, st *ses
 	link_post := r.FormValue("link_post") == "on" 
 	url_link := r.FormValue("url_link")
 
+	level, ok := formLevel(r, db, curr_pg.Level)
+	if !ok {
+		w.Write([]byte("Unknown access level"))
+		return
+	}
+
+	// the slug only changes with the title or when a custom one is given, it can't be
+	// another page's title or old title
+	new_title := curr_pg.Title
+	custom_slug := r.FormValue("slug")
+	if custom_slug != curr_pg.Title && (custom_slug != "" || display_title != curr_pg.DisplayTitle) {
+		new_title, err = pageSlug(tx, custom_slug, display_title, pageID)
+		if err == errSlugTaken {
+			w.Write([]byte("Slug already in use"))
+			return
+		} else if err == errInvalidSlug {
+			w.Write([]byte("Invalid slug, " + err.Error()))
+			return
+		} else if err != nil {
+			log.Printf("error picking slug of '%v': %v", curr_pg.Title, err)
+			w.Write([]byte("Error updating page content"))
+			return
+		}
+	}
+
 	// Update the main page content
 	updateQuery := `
         UPDATE pages 
         SET content = ?,
+            content_html = '',
             post_time = ?,
             unlisted = ?,
 			title = ?,
 			display_title = ?,
 			link_post = ?,
-			url_link = ?
+			url_link = ?,
+			level = ?,
+			status = ?,
+			saved_at = CURRENT_TIMESTAMP
         WHERE id = ?
     `
     _, err = tx.Exec(updateQuery, 
         r.FormValue("description"),
         post_time,
         r.FormValue("unlisted") == "on",
-		sanitizeTitle(display_title),
+		new_title,
 		display_title,
 		link_post,
 		url_link,
+		level,
+		status,
         pageID,
 		)
     if err != nil {
@@ -549,122 +734,154 @@ func EditPageHandler(w http.ResponseWriter, r *http.Request, db *sql.DB, st *ses
         return
     }
 
+	// links to the old title keep working, drafts never had any
+	if curr_pg.Status == PAGE_PUBLISHED {
+		err = renameSlug(tx, pageID, curr_pg.Title, new_title)
+		if err != nil {
+			log.Printf("error recording old title of '%v': %v", curr_pg.Title, err)
+			w.Write([]byte("Error updating page content"))
+			return
+		}
+	}
+
 
-    // Delete existing tags for this page
-    _, err = tx.Exec("DELETE FROM page_tags WHERE page_id = ?", pageID)
+    // Replace tags
+    err = setPageTags(tx, pageID, tags)
     if err != nil {
+        log.Printf("error updating tags: %v", err)
         w.Write([]byte("Error updating tags"))
         return
     }
 
-    // Add new tags
-    tags_string := r.FormValue("tags")
-    tags := strings.Fields(strings.ReplaceAll(tags_string, ",", " "))
-    
-    for _, tagName := range tags {
-        if tagName == "" {
-            continue
-        }
+	if r.Form.Has("series") {
+		err = setPageSeries(tx, pageID, formSeries(r))
+		if err == errUnknownSeries {
+			w.Write([]byte("Unknown series"))
+			return
+		} else if err != nil {
+			log.Printf("error updating series of '%v': %v", curr_pg.Title, err)
+			w.Write([]byte("Error updating series"))
+			return
+		}
+	}
 
-        // Insert tag if it doesn't exist and get its ID
-        var tagID int64
-        err = tx.QueryRow(`
-            INSERT INTO tags (name) 
-            VALUES (?) 
-            ON CONFLICT(name) DO UPDATE SET name=name 
-            RETURNING id`, tagName).Scan(&tagID)
-        if err != nil {
-            w.Write([]byte("Error updating tags"))
-            return
-        }
+	//
+	// update the gallery: captions, removals and order of current images, then new uploads
+	//
 
-        // Link tag to page
-        _, err = tx.Exec(`
-            INSERT INTO page_tags (page_id, tag_id) 
-            VALUES (?, ?)`, pageID, tagID)
-        if err != nil {
-            w.Write([]byte("Error linking tags"))
-            return
-        }
-    }
+	var job_ids []int64
+	kept := []PageImage{}
+	for _, img := range curr_pg.Images {
+		id := strconv.FormatInt(img.ID, 10)
+
+		if r.FormValue("remove_"+id) == "on" {
+			err = removePageImage(tx, pageID, img.ID)
+			if err != nil {
+				log.Printf("error removing image: %v", err)
+				w.Write([]byte("Error removing image"))
+				return
+			}
+			continue
+		}
 
-    // Clean up unused tags
-    _, err = tx.Exec(`
-        DELETE FROM tags 
-        WHERE NOT EXISTS (
-            SELECT 1 
-            FROM page_tags 
-            WHERE page_tags.tag_id = tags.id
-        )
-    `)
-    if err != nil {
-        log.Printf("error cleaning up tags: %v", err)
-        // Non-critical error, don't return
-    }
+		if r.Form.Has("caption_" + id) {
+			img.Caption = r.FormValue("caption_" + id)
+			img.AltText = r.FormValue("alt_" + id)
+		}
+		if pos, err := strconv.Atoi(r.FormValue("position_" + id)); err == nil {
+			img.Position = pos
+		}
 
-	//
-	// modify the image, if a new image was given
-	//
+		// a moved focal point queues a new thumbnail
+		focus := parseFocus("", r.FormValue("focal_x_"+id), r.FormValue("focal_y_"+id))
+		if r.Form.Has("focal_x_"+id) && focus != img.Focus {
+			img.Focus = focus
+			job_id, err := q.EnqueueTx(tx, JOB_IMAGE_DERIVATIVES, imageJob{PageID: pageID, Hash: img.Hash}, requesting_uploader)
+			if err != nil {
+				log.Printf("error queueing thumbnail: %v", err)
+				w.Write([]byte("Error updating images"))
+				return
+			}
+			job_ids = append(job_ids, job_id)
+		}
+		kept = append(kept, img)
+	}
+
+	kept_videos := 0
+	for _, v := range curr_pg.Videos {
+		if r.FormValue("remove_video_"+strconv.FormatInt(v.ID, 10)) == "on" {
+			err = removePageVideo(tx, pageID, v.ID)
+			if err != nil {
+				log.Printf("error removing video: %v", err)
+				w.Write([]byte("Error removing video"))
+				return
+			}
+			continue
+		}
+		kept_videos++
+	}
 
-	file, _, err := r.FormFile("image")
-	if err != nil {
-		// No image to update, commit transaction
-		if err = tx.Commit(); err != nil {
-			w.Write([]byte("Error saving changes"))
+	if new_video != nil {
+		kept_videos++
+		videoID, err := addPageVideo(tx, pageID, new_video)
+		if err != nil {
+			log.Printf("error adding video: %v", err)
+			w.Write([]byte("Error adding video"))
 			return
 		}
-		w.Header().Set("Content-Type", "text/html")
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte(`
-			<div class="alert alert-success">
-				Page updated successfully! (no image update provided)
-			</div>
-		`))
-		return
+		if new_video.Poster != nil {
+			job_id, err := q.EnqueueTx(tx, JOB_POSTER_THUMBNAIL, posterJob{VideoID: videoID}, requesting_uploader)
+			if err != nil {
+				log.Printf("error queueing poster thumbnail: %v", err)
+				w.Write([]byte("Error adding video"))
+				return
+			}
+			job_ids = append(job_ids, job_id)
+		}
 	}
 
-	// image exists, update the image
+	if status == PAGE_PUBLISHED && len(kept)+len(new_images)+kept_videos == 0 {
+		w.Write([]byte("A page needs at least one image or video"))
+		return
+	}
 
-	defer file.Close()
+	sort.SliceStable(kept, func(i, j int) bool { return kept[i].Position < kept[j].Position })
+	for i, img := range kept {
+		_, err = tx.Exec("UPDATE page_images SET position = ?, caption = ?, alt_text = ?, focal_x = ?, focal_y = ? WHERE id = ?",
+			i, img.Caption, img.AltText, img.Focus.X, img.Focus.Y, img.ID)
+		if err != nil {
+			log.Printf("error updating image %v: %v", img.ID, err)
+			w.Write([]byte("Error updating images"))
+			return
+		}
+	}
 
-	file_bytes, err := io.ReadAll(file)
+	err = addPageImages(tx, pageID, new_images, display_title)
 	if err != nil {
+		log.Printf("error adding images: %v", err)
+		w.Write([]byte("Error adding images"))
 		return
 	}
 
-	file64 := base64.StdEncoding.EncodeToString(file_bytes)
-
-	// make thumbnail image64
-	thumb, _, err := image.Decode(bytes.NewReader(file_bytes)); if err != nil {
-		w.Write([]byte("Error decoding image for thumbnail"))
+	image_jobs, err := enqueueImageJobs(tx, q, pageID, new_images, requesting_uploader)
+	if err != nil {
+		log.Printf("error queueing image jobs: %v", err)
+		w.Write([]byte("Error adding images"))
 		return
 	}
+	job_ids = append(job_ids, image_jobs...)
 
-	thumb = imaging.Fill(thumb, 300, 300, imaging.Top, imaging.Lanczos)
-	var buf bytes.Buffer
-	err = imaging.Encode(&buf, thumb, imaging.JPEG, imaging.JPEGQuality(80))
+	err = syncCoverImage(tx, pageID)
 	if err != nil {
-		w.Write([]byte("Error encoding image for thumbnail"))
+		log.Printf("error updating cover image: %v", err)
+		w.Write([]byte("Error updating images"))
 		return
 	}
 
-	small64 := base64.StdEncoding.EncodeToString(buf.Bytes())
-
-	// update database
-
-	img_update_query := `
-		UPDATE pages 
-		SET image = ?,
-			thumbnail = ?
-		WHERE id = ?
-	`
-	_, err = tx.Exec(img_update_query, 
-		file64,
-		small64,
-		pageID)
+	err = saveRevision(tx, pageID, requesting_uploader)
 	if err != nil {
-		log.Printf("error updating image: %v", err)
-		w.Write([]byte("Error updating image"))
+		log.Printf("error saving revision: %v", err)
+		w.Write([]byte("Error saving changes"))
 		return
 	}
 
@@ -674,11 +891,22 @@ func EditPageHandler(w http.ResponseWriter, r *http.Request, db *sql.DB, st *ses
 		return
 	}
 
+	q.Wake()
+
+	if new_video != nil && new_video.Poster != nil {
+		new_images = append(new_images, *new_video.Poster)
+	}
+
+	if curr_pg.Status == PAGE_DRAFT && status == PAGE_PUBLISHED {
+		w.Header().Set("HX-Redirect", pageURL(pageID, new_title))
+		return
+	}
+
 	w.Header().Set("Content-Type", "text/html")
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte(`
 		<div class="alert alert-success">
-			Page and image updated successfully!
+			Page updated successfully!` + metadataSummary(new_images) + jobs.PollingStatus(job_ids) + `
 		</div>
 	`))
 }
@@ -689,10 +917,20 @@ func EditPage(w http.ResponseWriter, r *http.Request, db *sql.DB, st *sessions.C
 		return
 	}
 
-	title := r.URL.Path[len("/edit-page/"):]
+	pageID, err := pathID(r.URL.Path, "/edit-page/")
+	if err != nil {
+		RenderTemplate(w, r, "NotFound", nil, st)
+		return
+	}
 
-	pg, err := getPageFromDB(title, db); if err != nil {
-		log.Printf("error getting '%v': %v", title, err)
+	pg, err := getPageFromDB(pageID, db); if err != nil {
+		log.Printf("error getting page %v: %v", pageID, err)
+		RenderTemplate(w, r, "NotFound", nil, st)
+		return
+	}
+
+	if pg.Status == PAGE_DRAFT && !canSeeDraft(r, st, pg.Uploader) {
+		RenderTemplate(w, r, "NotFound", nil, st)
 		return
 	}
 
@@ -704,9 +942,26 @@ func EditPage(w http.ResponseWriter, r *http.Request, db *sql.DB, st *sessions.C
 		return names
 	}(), " ")
 
+	levels, err := users.GetSubscriptionLevels(db)
+	if err != nil {
+		log.Printf("error getting subscription levels: %v", err)
+	}
+
+	series, err := getAllSeries(db)
+	if err != nil {
+		log.Printf("error getting series: %v", err)
+	}
+	seriesID, err := pageSeriesID(db, pg.ID)
+	if err != nil {
+		log.Printf("error getting series of '%v': %v", pg.Title, err)
+	}
+
 	data := map[string]interface{}{
 		"Page": pg,
 		"TagString": tag_string,
+		"Levels": levels,
+		"Series": series,
+		"SeriesID": seriesID,
 	}
 
 	RenderTemplate(w, r, "Edit Page", data, st)	
@@ -725,9 +980,9 @@ func DeletePageHandler(w http.ResponseWriter, r *http.Request, db *sql.DB, st *s
 		return
 	}
 
-	title := r.Form.Get("title")
-	if title == "" {
-		log.Printf("couldn't get title when deleting")
+	pageID, err := strconv.ParseInt(r.Form.Get("page_id"), 10, 64)
+	if err != nil {
+		log.Printf("couldn't get page id when deleting")
 		http.Error(w, "Invalid request", http.StatusBadRequest)
 		return
 	}
@@ -740,74 +995,57 @@ func DeletePageHandler(w http.ResponseWriter, r *http.Request, db *sql.DB, st *s
 	}
 	defer tx.Rollback()
 
-	// First get the page ID
-	var pageID int64
-	err = tx.QueryRow("SELECT id FROM pages WHERE title = ?", title).Scan(&pageID)
+	err = deletePage(tx, pageID)
 	if err != nil {
-		log.Printf("error getting page ID: %v", err)
+		log.Printf("failed to delete %v: %v", pageID, err)
+		http.Error(w, "Invalid request", http.StatusBadRequest)
 		return
 	}
 
-	_, err = tx.Exec("DELETE FROM page_tags WHERE page_id = ?", pageID)
+	err = tx.Commit()
 	if err != nil {
-		log.Printf("error deleting page_tags: %v", err)
+		log.Printf("error committing transaction: %v", err)
 		return
 	}
 
-	stmt, err := tx.Prepare("DELETE FROM pages WHERE title = ?")
-	if err != nil {
-		log.Printf("error preparing delete statement: %v", err)
-		return
+	w.Header().Set("HX-Redirect", "/")
+}
+
+// deletePage removes a page with everything attached to it, and tags no page uses anymore
+func deletePage(tx *sql.Tx, pageID int64) error {
+	for _, table := range []string{"page_tags", "page_image_variants", "page_images", "page_videos", "page_revisions", "page_slugs", "series_pages"} {
+		_, err := tx.Exec("DELETE FROM "+table+" WHERE page_id = ?", pageID)
+		if err != nil {
+			return fmt.Errorf("error deleting %v: %w", table, err)
+		}
 	}
-	defer stmt.Close()
 
-	result, err := stmt.Exec(title)
+	result, err := tx.Exec("DELETE FROM pages WHERE id = ?", pageID)
 	if err != nil {
-		log.Printf("failed to execute delete for %v: %v", title, err)
-		http.Error(w, "Invalid request", http.StatusBadRequest)
-		return
+		return fmt.Errorf("failed to execute delete: %w", err)
 	}
 
 	// Check if a row was affected
 	rowsAffected, err := result.RowsAffected()
 	if err != nil {
-		log.Printf("failed to retrieve affected rows: %v", err)
-		http.Error(w, "Invalid request", http.StatusBadRequest)
-		return
+		return fmt.Errorf("failed to retrieve affected rows: %w", err)
 	}
 	if rowsAffected == 0 {
-		log.Printf("no row found with the title: %s", title)
-		http.Error(w, "Invalid request", http.StatusBadRequest)
-		return
+		return fmt.Errorf("no page with id %v", pageID)
 	}
 
 	// Clean up unused tags
-	_, err = tx.Exec(`
-        DELETE FROM tags 
-        WHERE NOT EXISTS (
-            SELECT 1 
-            FROM page_tags 
-            WHERE page_tags.tag_id = tags.id
-        )
-    `)
+	err = cleanUpTags(tx)
 	if err != nil {
-		log.Printf("error cleaning up tags: %v", err)
-		return
+		return fmt.Errorf("error cleaning up tags: %w", err)
 	}
-
-	err = tx.Commit()
-	if err != nil {
-		log.Printf("error committing transaction: %v", err)
-		return
-	}
-
-	w.Header().Set("HX-Redirect", "/")
+	return nil
 }
 
 func GetPostTags(ID int64, db *sql.DB) ([]Tag, error) {
 	rows, err := db.Query(
 		`
-		SELECT t.id, t.name
+		SELECT t.id, t.name, t.description
 		FROM tags t
 		JOIN page_tags pt on t.id = pt.tag_id
 		WHERE pt.page_id = ?
@@ -821,7 +1059,7 @@ func GetPostTags(ID int64, db *sql.DB) ([]Tag, error) {
 	var tags []Tag
 	for rows.Next() {
 		var tag Tag
-		if err := rows.Scan(&tag.ID, &tag.Name); err != nil {
+		if err := rows.Scan(&tag.ID, &tag.Name, &tag.Description); err != nil {
 			return nil, err
 		}
 		tags = append(tags, tag)
@@ -839,27 +1077,37 @@ func incrementPageViews(db *sql.DB, pageID int64) error {
     return err
 }
 
-func getPageFromDB(title string, db *sql.DB) (*BlogPage, error) {
-	query := "SELECT id, title, display_title, content, post_time, image, uploader, views, link_post, url_link FROM pages WHERE title = ?"
+func getPageFromDB(pageID int64, db *sql.DB) (*BlogPage, error) {
+	query := "SELECT id, title, display_title, content, post_time, image, uploader, views, link_post, url_link, IFNULL(unlisted, 0), status, level FROM pages WHERE id = ?"
 
-	row := db.QueryRow(query, title)
+	row := db.QueryRow(query, pageID)
 	var p BlogPage
 
 	// TODO: update so it gives a different err for it being missing from database vs some other issue
-	err := row.Scan(&p.ID, &p.Title, &p.DisplayTitle, &p.Content, &p.PostTime, &p.Image, &p.Uploader, &p.Views, &p.LinkPost, &p.UrlLink)
+	err := row.Scan(&p.ID, &p.Title, &p.DisplayTitle, &p.Content, &p.PostTime, &p.Image, &p.Uploader, &p.Views, &p.LinkPost, &p.UrlLink, &p.Unlisted, &p.Status, &p.Level)
 	if err != nil {
 		return nil, err
 	}
 
+	p.Images, err = getPageImages(db, p.ID)
+	if err != nil {
+		return nil, fmt.Errorf("error getting images for '%v': %v", p.Title, err)
+	}
+
+	p.Videos, err = getPageVideos(db, p.ID)
+	if err != nil {
+		return nil, fmt.Errorf("error getting videos for '%v': %v", p.Title, err)
+	}
+
 	// get tags from DB
 	p.Tags, err = GetPostTags(p.ID, db)
 	if err != nil {
-		return nil, fmt.Errorf("error getting tags for '%v': %v", title, err)
+		return nil, fmt.Errorf("error getting tags for '%v': %v", p.Title, err)
 	}
 
 	comments, err := getCommentsForPage(db, p.ID)
 	if err != nil {
-		return nil, fmt.Errorf("error getting comments for '%v': %v", title, err)
+		return nil, fmt.Errorf("error getting comments for '%v': %v", p.Title, err)
 	}
 	p.Comments = comments
 
@@ -908,6 +1156,15 @@ func AddCommentHandler(w http.ResponseWriter, r *http.Request, db *sql.DB, st *s
 		return
 	}
 
+	// only pages the user can open, and read, take comments
+	var p BlogPage
+	err = db.QueryRow("SELECT level, uploader, status, post_time FROM pages WHERE id = ?", pageIDInt).
+		Scan(&p.Level, &p.Uploader, &p.Status, &p.PostTime)
+	if err != nil || !canSeePage(r, st, p) || !canReadPage(r, db, st, p.Level, p.Uploader) {
+		http.Error(w, "Invalid page ID", http.StatusBadRequest)
+		return
+	}
+
 	username, _ := users.GetCurrentUsername(r, st)
 
 	err = addComment(db, pageIDInt, username, content)
@@ -971,102 +1228,47 @@ func getCommentsForPage(db *sql.DB, pageID int64) ([]Comment, error) {
 // Page navigation buttons, get next page/get previous page with tags
 //
 
-func getAdjacentPage(query string, title string, tag string, db *sql.DB) (string, error) {
-    var adj_title string
-    var err error
-    
-    if tag != "" {
-        err = db.QueryRow(query, title, tag).Scan(&adj_title)
-    } else {
-        err = db.QueryRow(query, title).Scan(&adj_title)
-    }
-    
+// getAdjacentPage returns the id, title and display title of the page query finds, nil if there's none
+func getAdjacentPage(query string, args []interface{}, db *sql.DB) (*BlogPage, error) {
+    var adj BlogPage
+    err := db.QueryRow(query, args...).Scan(&adj.ID, &adj.Title, &adj.DisplayTitle)
     if err != nil {
         if err == sql.ErrNoRows {
-            return "", nil
+            return nil, nil
         }
         log.Printf("Error getting next page %v", err)
-        return "", err
+        return nil, err
     }
 
-    return adj_title, nil
+    return &adj, nil
 }
 
-func getNextPage(title string, tag string, db *sql.DB) (string, error) {
-    var query string
-
-    if tag != "" {
-        // Query with tag filter
-        query = `
-            WITH current_time AS (
-                SELECT post_time 
-                FROM pages 
-                WHERE title = ?
-            )
-            SELECT p.title 
-            FROM pages p
-            JOIN page_tags pt ON p.id = pt.page_id
-            JOIN tags t ON pt.tag_id = t.id
-            WHERE p.post_time > (SELECT post_time FROM current_time)
-            AND t.name = ?
-            ORDER BY p.post_time ASC
-            LIMIT 1
-        `
-    } else {
-        query = `
-            SELECT title 
-            FROM pages 
-            WHERE post_time > (
-                SELECT post_time 
-                FROM pages 
-                WHERE title = ?
-            )
-            ORDER BY post_time ASC
-            LIMIT 1
-        `
-    }
+func getNextPage(pageID int64, filter TagFilter, show_hidden bool, db *sql.DB) (*BlogPage, error) {
+    tags, args := filter.where("p")
+    query := `
+        SELECT p.id, p.title, p.display_title 
+        FROM pages p
+        WHERE p.post_time > (SELECT post_time FROM pages WHERE id = ?)
+        AND ` + tags + ` AND ` + visibleFilter("p", show_hidden) + `
+        ORDER BY p.post_time ASC
+        LIMIT 1
+    `
 
-    return getAdjacentPage(query, title, tag, db)
+    return getAdjacentPage(query, append([]interface{}{pageID}, args...), db)
 }
 
-func getPrevPage(title string, tag string, db *sql.DB) (string, error) {
-
-	var query string
-
-    if tag != "" {
-        // Query with tag filter
-        query = `
-            WITH current_time AS (
-                SELECT post_time 
-                FROM pages 
-                WHERE title = ?
-            )
-            SELECT p.title 
-            FROM pages p
-            JOIN page_tags pt ON p.id = pt.page_id
-            JOIN tags t ON pt.tag_id = t.id
-            WHERE p.post_time < (SELECT post_time FROM current_time)
-            AND t.name = ?
-            ORDER BY p.post_time DESC
-            LIMIT 1
-        `
-    } else {
-        query = `
-			SELECT title 
-			FROM pages 
-			WHERE post_time < (
-				SELECT post_time 
-				FROM pages 
-				WHERE title = ?
-			)
-			ORDER BY post_time DESC
-			LIMIT 1
-		`
-    }
-
-	adj, err := getAdjacentPage(query, title, tag, db)
+func getPrevPage(pageID int64, filter TagFilter, show_hidden bool, db *sql.DB) (*BlogPage, error) {
+    tags, args := filter.where("p")
+    query := `
+        SELECT p.id, p.title, p.display_title 
+        FROM pages p
+        WHERE p.post_time < (SELECT post_time FROM pages WHERE id = ?)
+        AND ` + tags + ` AND ` + visibleFilter("p", show_hidden) + `
+        ORDER BY p.post_time DESC
+        LIMIT 1
+    `
 
-	return adj, err
+    return getAdjacentPage(query, append([]interface{}{pageID}, args...), db)
 }
 
 //
@@ -1080,18 +1282,37 @@ func PageRequest(w http.ResponseWriter, r *http.Request, db *sql.DB, st *session
 		return
 	}
 
-	title := r.URL.Path[len("/page/"):]
-
+	// /p/{id}/{slug}, only the id is used to find the page
+	pageID, err := pathID(r.URL.Path, "/p/")
+	if err != nil {
+		RenderTemplate(w, r, "NotFound", nil, st)
+		return
+	}
+	_, slug, _ := strings.Cut(r.URL.Path[len("/p/"):], "/")
 
-	// follow tag is "" if no param in url
- 	follow_tag := r.URL.Query().Get("tag")
+	// the tags the page was opened with, prev/next stay within them
+	follow := parseTagFilter(db, r.URL.Query())
 
-	p, err := getPageFromDB(title, db)
+	p, err := getPageFromDB(pageID, db)
 	if err != nil {
-		log.Printf("Error getting generic page '%v' from database: %v", title, err)
+		log.Printf("Error getting generic page %v from database: %v", pageID, err)
 		RenderTemplate(w, r, "NotFound", nil, st)
 		return
 	}
+	title := p.Title
+
+	if !canSeePage(r, st, *p) {
+		RenderTemplate(w, r, "NotFound", nil, st)
+		return
+	}
+	show_hidden := canSeeHidden(r, st)
+
+	// a missing or outdated slug goes to the canonical url, only once the page can be
+	// seen so the redirect doesn't give away hidden titles
+	if slug != p.Title {
+		redirectToPage(w, r, p.ID, p.Title)
+		return
+	}
 
 	err = incrementPageViews(db, p.ID)
     if err != nil {
@@ -1099,6 +1320,18 @@ func PageRequest(w http.ResponseWriter, r *http.Request, db *sql.DB, st *session
         // continue anyway
     }
 
+	// users without the page's access level get a teaser
+	locked := !canReadPage(r, db, st, p.Level, p.Uploader)
+	if locked {
+		lockPage(p)
+	} else {
+		p.ContentHTML, err = pageContentHTML(db, p)
+		if err != nil {
+			log.Printf("Error rendering content of page '%v': %v", title, err)
+			p.ContentHTML = template.HTML(template.HTMLEscapeString(p.Content))
+		}
+	}
+
 	// Rendering a post page with template (different case than RenderTemplate)
 
 	tmpl, err := template.ParseFiles("templates/base.html", "templates/Page.html", "templates/Comments.html")
@@ -1119,13 +1352,19 @@ func PageRequest(w http.ResponseWriter, r *http.Request, db *sql.DB, st *session
 
 	// TODO: add first/last
 	// get next and prev page (returns "" if no next/prev page exists)
-	next, err := getNextPage(p.Title, follow_tag, db); if err != nil {
+	next, err := getNextPage(p.ID, follow, show_hidden, db); if err != nil {
 		log.Printf("Error getting next page: %v", err)
 	}
-	prev, err := getPrevPage(p.Title, follow_tag, db); if err != nil {
+	prev, err := getPrevPage(p.ID, follow, show_hidden, db); if err != nil {
 		log.Printf("Error getting prev page: %v", err)
 	}
 
+	// part N of M and the pages around it, nil if the page isn't in a series
+	series, err := pageSeriesPart(db, p.ID, show_hidden)
+	if err != nil {
+		log.Printf("Error getting series of page '%v': %v", title, err)
+	}
+
 	content := map[string]interface{}{
 		"Title":    	p.Title,
 		"DisplayTitle": p.DisplayTitle,
@@ -1134,7 +1373,10 @@ func PageRequest(w http.ResponseWriter, r *http.Request, db *sql.DB, st *session
 		"Uploader": 	uploader,
 		"NextPage": 	next,
 		"PrevPage": 	prev,
-		"FollowTag": 	follow_tag,
+		"Filter": 		follow,
+		"Locked": 		locked,
+		"Series": 		series,
+		"Canonical": 	siteURL(r) + p.URL(),
 		"Data":     	p,
 	}
 
@@ -1144,3 +1386,40 @@ func PageRequest(w http.ResponseWriter, r *http.Request, db *sql.DB, st *session
 		return
 	}
 }
+
+// PageSlugRedirect sends old /page/{title} links to the page's canonical url, titles the
+// page had before included
+func PageSlugRedirect(w http.ResponseWriter, r *http.Request, db *sql.DB, st *sessions.CookieStore) {
+	if !users.IsAuthed(r, st) {
+		RenderSplash(w, r)
+		return
+	}
+
+	title := r.URL.Path[len("/page/"):]
+
+	pageID, current, err := pageBySlug(db, title)
+	if err != nil {
+		RenderTemplate(w, r, "NotFound", nil, st)
+		return
+	}
+
+	// the redirect gives away the page's current title, so it needs the same checks as the page
+	p := BlogPage{ID: pageID}
+	err = db.QueryRow("SELECT uploader, status, post_time FROM pages WHERE id = ?", pageID).
+		Scan(&p.Uploader, &p.Status, &p.PostTime)
+	if err != nil || !canSeePage(r, st, p) {
+		RenderTemplate(w, r, "NotFound", nil, st)
+		return
+	}
+	redirectToPage(w, r, pageID, current)
+}
+
+// redirectToPage permanently redirects to the canonical url of a page, keeping the query
+// (?tag=...)
+func redirectToPage(w http.ResponseWriter, r *http.Request, pageID int64, title string) {
+	target := pageURL(pageID, title)
+	if r.URL.RawQuery != "" {
+		target += "?" + r.URL.RawQuery
+	}
+	http.Redirect(w, r, target, http.StatusMovedPermanently)
+}
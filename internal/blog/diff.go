@@ -0,0 +1,104 @@
+package blog
+
+import (
+	// golang
+	"strings"
+)
+
+// largest (lines a * lines b) diffed line by line, bigger changes show as a full replace
+const MAX_DIFF_CELLS = 4_000_000
+
+// DiffLine is one line of a line diff, Op is "+" (added), "-" (removed) or " " (unchanged)
+type DiffLine struct {
+	Op   string
+	Text string
+}
+
+// diffLines returns a line diff turning a into b, from the longest common subsequence of lines
+func diffLines(a string, b string) []DiffLine {
+	a_lines := splitLines(a)
+	b_lines := splitLines(b)
+
+	// common prefix/suffix are kept out of the table, most edits are small
+	prefix := 0
+	for prefix < len(a_lines) && prefix < len(b_lines) && a_lines[prefix] == b_lines[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a_lines)-prefix && suffix < len(b_lines)-prefix &&
+		a_lines[len(a_lines)-1-suffix] == b_lines[len(b_lines)-1-suffix] {
+		suffix++
+	}
+
+	var diff []DiffLine
+	for _, line := range a_lines[:prefix] {
+		diff = append(diff, DiffLine{" ", line})
+	}
+
+	x := a_lines[prefix : len(a_lines)-suffix]
+	y := b_lines[prefix : len(b_lines)-suffix]
+	if len(x)*len(y) > MAX_DIFF_CELLS {
+		for _, line := range x {
+			diff = append(diff, DiffLine{"-", line})
+		}
+		for _, line := range y {
+			diff = append(diff, DiffLine{"+", line})
+		}
+	} else {
+		diff = append(diff, lcsDiff(x, y)...)
+	}
+
+	for _, line := range a_lines[len(a_lines)-suffix:] {
+		diff = append(diff, DiffLine{" ", line})
+	}
+	return diff
+}
+
+func lcsDiff(x []string, y []string) []DiffLine {
+	// lcs[i][j] is the length of the lcs of x[i:] and y[j:]
+	lcs := make([][]int, len(x)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(y)+1)
+	}
+	for i := len(x) - 1; i >= 0; i-- {
+		for j := len(y) - 1; j >= 0; j-- {
+			if x[i] == y[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	var diff []DiffLine
+	i, j := 0, 0
+	for i < len(x) && j < len(y) {
+		switch {
+		case x[i] == y[j]:
+			diff = append(diff, DiffLine{" ", x[i]})
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			diff = append(diff, DiffLine{"-", x[i]})
+			i++
+		default:
+			diff = append(diff, DiffLine{"+", y[j]})
+			j++
+		}
+	}
+	for ; i < len(x); i++ {
+		diff = append(diff, DiffLine{"-", x[i]})
+	}
+	for ; j < len(y); j++ {
+		diff = append(diff, DiffLine{"+", y[j]})
+	}
+	return diff
+}
+
+func splitLines(s string) []string {
+	s = strings.ReplaceAll(s, "\r\n", "\n")
+	if s == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+}
@@ -0,0 +1,77 @@
+package blog
+
+import (
+	// golang
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// renders a diff as "op+text" lines so expectations read like a unified diff
+func renderDiff(diff []DiffLine) []string {
+	out := []string{}
+	for _, d := range diff {
+		out = append(out, d.Op+d.Text)
+	}
+	return out
+}
+
+func TestDiffLines(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b string
+		want []string
+	}{
+		{"both empty", "", "", []string{}},
+		{"all added", "", "a\nb", []string{"+a", "+b"}},
+		{"all removed", "a\nb\n", "", []string{"-a", "-b"}},
+		{"unchanged", "a\nb\nc", "a\nb\nc", []string{" a", " b", " c"}},
+		{"trailing newline ignored", "a\nb\n", "a\nb", []string{" a", " b"}},
+		{"crlf matches lf", "a\r\nb\r\n", "a\nb\n", []string{" a", " b"}},
+		{"insert in the middle", "a\nc", "a\nb\nc", []string{" a", "+b", " c"}},
+		{"remove in the middle", "a\nb\nc", "a\nc", []string{" a", "-b", " c"}},
+		{"replace a line", "a\nb\nc", "a\nx\nc", []string{" a", "-b", "+x", " c"}},
+		{"removals before additions", "a\nb", "x\ny", []string{"-a", "-b", "+x", "+y"}},
+		{"duplicate lines", "a\na\nb\na", "a\nb\na\na", []string{" a", "-a", " b", "+a", " a"}},
+		{"unicode lines", "héllo\n日本語\n🎮", "héllo\n日本\n🎮", []string{" héllo", "-日本語", "+日本", " 🎮"}},
+		{"whitespace is significant", "a \nb", "a\nb", []string{"-a ", "+a", " b"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := renderDiff(diffLines(tt.a, tt.b))
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("diffLines(%q, %q) = %q, want %q", tt.a, tt.b, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDiffLinesTooLarge(t *testing.T) {
+	// past MAX_DIFF_CELLS the changed middle is shown as a full replace, the common ends are kept
+	var a, b []string
+	for i := 0; i < 2001; i++ {
+		a = append(a, fmt.Sprintf("a%v", i))
+		b = append(b, fmt.Sprintf("b%v", i))
+	}
+	old := "top\n" + strings.Join(a, "\n") + "\nshared\nbottom"
+	new := "top\n" + strings.Join(b, "\n") + "\nshared\nbottom"
+
+	got := diffLines(old, new)
+	if len(got) != 1+2*2001+2 {
+		t.Fatalf("got %v lines, want %v", len(got), 1+2*2001+2)
+	}
+	if got[0] != (DiffLine{" ", "top"}) || got[len(got)-1] != (DiffLine{" ", "bottom"}) || got[len(got)-2] != (DiffLine{" ", "shared"}) {
+		t.Errorf("common prefix/suffix not kept: first %v, last %v", got[0], got[len(got)-2:])
+	}
+	for i, d := range got[1 : len(got)-2] {
+		want := "-"
+		if i >= 2001 {
+			want = "+"
+		}
+		if d.Op != want {
+			t.Fatalf("line %v is %q, want all removals then all additions", i+1, d.Op+d.Text)
+		}
+	}
+}
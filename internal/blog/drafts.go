@@ -0,0 +1,342 @@
+package blog
+
+import (
+	// internal
+	"blog/internal/users"
+
+	// golang
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	// externals
+	"github.com/gorilla/sessions"
+)
+
+// page status, drafts are only visible to their uploader (and admins) until published,
+// published pages with a post time in the future are only visible to uploaders until then
+// and unlisted pages are left out of listings for everyone else
+const (
+	PAGE_DRAFT     = "draft"
+	PAGE_PUBLISHED = "published"
+)
+
+// errNoMedia is returned when publishing a page without any image or video
+var errNoMedia = errors.New("page has no image or video")
+
+// publishedFilter is the WHERE condition for pages anyone can see, alias is the pages table alias ("" for none)
+func publishedFilter(alias string) string {
+	return column(alias, "status") + " = '" + PAGE_PUBLISHED + "'"
+}
+
+// liveFilter is the WHERE condition for pages that have gone live, published and
+// not scheduled for later, alias as for publishedFilter
+func liveFilter(alias string) string {
+	return publishedFilter(alias) + " AND datetime(" + column(alias, "post_time") + ") <= datetime('now')"
+}
+
+// listedFilter is the WHERE condition for pages listed to everyone, live and not unlisted
+// (unlisted pages are only reachable by a direct link)
+func listedFilter(alias string) string {
+	return liveFilter(alias) + " AND IFNULL(" + column(alias, "unlisted") + ", 0) = 0"
+}
+
+// visibleFilter is listedFilter, or publishedFilter when scheduled and unlisted pages are shown too
+func visibleFilter(alias string, show_hidden bool) string {
+	if show_hidden {
+		return publishedFilter(alias)
+	}
+	return listedFilter(alias)
+}
+
+func column(alias string, name string) string {
+	if alias == "" {
+		return name
+	}
+	return alias + "." + name
+}
+
+// canSeeHidden reports whether the current user sees scheduled and unlisted pages in listings
+func canSeeHidden(r *http.Request, st *sessions.CookieStore) bool {
+	return users.IsUploader(r, st) || users.IsAdmin(r, st)
+}
+
+// Scheduled reports whether a page's post time is still to come
+func (p BlogPage) Scheduled() bool {
+	return p.PostTime.After(time.Now())
+}
+
+// canSeePage reports whether the current user can open a page: drafts only by their uploader
+// (or an admin) and scheduled pages only by uploaders/admins until their post time
+func canSeePage(r *http.Request, st *sessions.CookieStore, p BlogPage) bool {
+	if p.Status == PAGE_DRAFT && !canSeeDraft(r, st, p.Uploader) {
+		return false
+	}
+	return !p.Scheduled() || canSeeHidden(r, st)
+}
+
+// canSeeDraft reports whether the current user can view (and edit) a draft by uploader
+func canSeeDraft(r *http.Request, st *sessions.CookieStore, uploader string) bool {
+	username, err := users.GetCurrentUsername(r, st)
+	return (err == nil && username == uploader) || users.IsAdmin(r, st)
+}
+
+// pageStatus reads the status a form asks for, falling back to current
+func pageStatus(r *http.Request, current string) string {
+	switch r.FormValue("status") {
+	case PAGE_DRAFT:
+		return PAGE_DRAFT
+	case PAGE_PUBLISHED:
+		return PAGE_PUBLISHED
+	}
+	return current
+}
+
+// hasMedia reports whether a page has at least one image or video
+func hasMedia(tx *sql.Tx, pageID int64) (bool, error) {
+	var exists bool
+	err := tx.QueryRow(`
+		SELECT EXISTS(SELECT 1 FROM page_images WHERE page_id = ?1)
+			OR EXISTS(SELECT 1 FROM page_videos WHERE page_id = ?1)`, pageID).Scan(&exists)
+	return exists, err
+}
+
+//
+// My drafts
+//
+
+func DraftsPage(w http.ResponseWriter, r *http.Request, db *sql.DB, st *sessions.CookieStore) {
+	if !users.IsUploader(r, st) {
+		log.Printf("non uploader attempted to access drafts page: %v", r.Host)
+		RenderTemplate(w, r, "NotFound", nil, st)
+		return
+	}
+
+	username, err := users.GetCurrentUsername(r, st)
+	if err != nil {
+		RenderTemplate(w, r, "NotFound", nil, st)
+		return
+	}
+
+	rows, err := db.Query(`
+		SELECT id, title, display_title, thumbnail, saved_at
+		FROM pages
+		WHERE status = ? AND uploader = ?
+		ORDER BY saved_at DESC, id DESC`, PAGE_DRAFT, username)
+	if err != nil {
+		log.Printf("failed to get drafts: %v", err)
+		return
+	}
+	defer rows.Close()
+
+	type draft struct {
+		BlogPage
+		SavedAt sql.NullTime
+	}
+	drafts := []draft{}
+	for rows.Next() {
+		var d draft
+		err := rows.Scan(&d.ID, &d.Title, &d.DisplayTitle, &d.Thumbnail, &d.SavedAt)
+		if err != nil {
+			log.Printf("failed to scan draft: %v", err)
+			return
+		}
+		drafts = append(drafts, d)
+	}
+
+	RenderTemplate(w, r, "My Drafts", drafts, st)
+}
+
+func DiscardDraftHandler(w http.ResponseWriter, r *http.Request, db *sql.DB, st *sessions.CookieStore) {
+	if !users.IsUploader(r, st) {
+		w.Write([]byte("Unauthorized access"))
+		return
+	}
+
+	pageID, err := strconv.ParseInt(r.FormValue("draft_id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid draft", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		w.Write([]byte("Database error"))
+		return
+	}
+	defer tx.Rollback()
+
+	var uploader, status string
+	err = tx.QueryRow("SELECT uploader, status FROM pages WHERE id = ?", pageID).Scan(&uploader, &status)
+	if err != nil || status != PAGE_DRAFT || !canSeeDraft(r, st, uploader) {
+		w.Write([]byte("Draft not found"))
+		return
+	}
+
+	err = deletePage(tx, pageID)
+	if err != nil {
+		log.Printf("error discarding draft %v: %v", pageID, err)
+		w.Write([]byte("Error discarding draft"))
+		return
+	}
+
+	if err = tx.Commit(); err != nil {
+		w.Write([]byte("Error discarding draft"))
+		return
+	}
+
+	w.Header().Set("HX-Redirect", "/drafts")
+}
+
+//
+// Autosave (htmx, text fields only)
+//
+
+// AutosaveHandler saves the text fields of the upload/edit form into a draft, creating
+// the draft on the first save of a new page. published pages are never autosaved,
+// their changes only go live when the form is submitted
+func AutosaveHandler(w http.ResponseWriter, r *http.Request, db *sql.DB, st *sessions.CookieStore) {
+	if !users.IsUploader(r, st) {
+		w.Write([]byte("Unauthorized access"))
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	username, err := users.GetCurrentUsername(r, st)
+	if err != nil {
+		w.Write([]byte("Unrecognized user"))
+		return
+	}
+
+	// the upload form calls it "title", the edit form "display_title"
+	display_title := r.FormValue("display_title")
+	if display_title == "" {
+		display_title = r.FormValue("title")
+	}
+	custom_slug := r.FormValue("slug")
+
+	draftID, _ := strconv.ParseInt(r.FormValue("draft_id"), 10, 64)
+	if draftID == 0 && display_title == "" && custom_slug == "" {
+		w.Write([]byte("Autosave starts once the page has a title"))
+		return
+	}
+
+	tags, err := parseTags(r.FormValue("tags"))
+	if err != nil {
+		w.Write([]byte(err.Error() + ", not autosaved"))
+		return
+	}
+
+	var post_time sql.NullTime
+	if s := r.FormValue("post_time"); s != "" {
+		t, err := time.Parse("2006-01-02T15:04", s)
+		if err == nil {
+			post_time = sql.NullTime{Time: t, Valid: true}
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		w.Write([]byte("Database error"))
+		return
+	}
+	defer tx.Rollback()
+
+	if draftID != 0 {
+		var uploader, status string
+		err = tx.QueryRow("SELECT uploader, status FROM pages WHERE id = ?", draftID).Scan(&uploader, &status)
+		if err != nil || !canSeeDraft(r, st, uploader) {
+			w.Write([]byte("Draft not found"))
+			return
+		}
+		if status != PAGE_DRAFT {
+			w.Write([]byte("Published pages are not autosaved"))
+			return
+		}
+	}
+
+	// without a title the draft keeps its slug
+	var title string
+	if display_title != "" || custom_slug != "" {
+		title, err = pageSlug(tx, custom_slug, display_title, draftID)
+		if err == errSlugTaken || err == errInvalidSlug {
+			w.Write([]byte(err.Error() + ", not autosaved"))
+			return
+		}
+		if err != nil {
+			w.Write([]byte("Database error"))
+			return
+		}
+	}
+
+	if draftID == 0 {
+		if !post_time.Valid {
+			post_time = sql.NullTime{Time: time.Now(), Valid: true}
+		}
+		result, err := tx.Exec(`
+			INSERT INTO pages (title, display_title, content, post_time, image, thumbnail, uploader, unlisted, link_post, url_link, status, saved_at)
+			VALUES (?, ?, ?, ?, '', '', ?, ?, ?, ?, ?, CURRENT_TIMESTAMP)`,
+			title, display_title, r.FormValue("description"), post_time.Time, username,
+			r.FormValue("unlisted") == "on", r.FormValue("link_post") == "on", r.FormValue("url_link"), PAGE_DRAFT)
+		if err == nil {
+			draftID, err = result.LastInsertId()
+		}
+		if err == nil && title == "" {
+			title, err = uniqueSlug(tx, idSlug(draftID), draftID)
+			if err == nil {
+				_, err = tx.Exec("UPDATE pages SET title = ? WHERE id = ?", title, draftID)
+			}
+		}
+		if err != nil {
+			log.Printf("error creating draft: %v", err)
+			w.Write([]byte("Error autosaving"))
+			return
+		}
+	} else {
+		_, err = tx.Exec(`
+			UPDATE pages
+			SET title = COALESCE(NULLIF(?, ''), title),
+				display_title = COALESCE(NULLIF(?, ''), display_title),
+				content = ?,
+				content_html = '',
+				post_time = COALESCE(?, post_time),
+				unlisted = ?,
+				link_post = ?,
+				url_link = ?,
+				saved_at = CURRENT_TIMESTAMP
+			WHERE id = ?`,
+			title, display_title, r.FormValue("description"), post_time,
+			r.FormValue("unlisted") == "on", r.FormValue("link_post") == "on", r.FormValue("url_link"), draftID)
+		if err != nil {
+			log.Printf("error autosaving draft %v: %v", draftID, err)
+			w.Write([]byte("Error autosaving"))
+			return
+		}
+	}
+
+	err = setPageTags(tx, draftID, tags)
+	if err != nil {
+		log.Printf("error autosaving tags of draft %v: %v", draftID, err)
+		w.Write([]byte("Error autosaving"))
+		return
+	}
+
+	if err = tx.Commit(); err != nil {
+		w.Write([]byte("Error autosaving"))
+		return
+	}
+
+	// the form keeps pointing at the draft
+	w.Write([]byte(fmt.Sprintf(`Draft autosaved at %v`+
+		`<input type="hidden" name="draft_id" id="draft-id" value="%v" hx-swap-oob="true">`,
+		time.Now().Format("15:04:05"), draftID)))
+}
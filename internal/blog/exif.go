@@ -0,0 +1,405 @@
+package blog
+
+import (
+	// golang
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"sort"
+	"strings"
+
+	// externals
+	"github.com/disintegration/imaging"
+	"github.com/rwcarlsen/goexif/exif"
+	"github.com/rwcarlsen/goexif/tiff"
+)
+
+// EXIF fields copied into re-encoded jpegs, set from EXIF_WHITELIST in main.
+// only the text fields in exifWhitelistable can be kept, everything else is always dropped
+var ExifWhitelist []string
+
+// text (ASCII) IFD0 fields that can be written back, name -> tag id
+var exifWhitelistable = map[string]uint16{
+	"ImageDescription": 0x010e,
+	"Artist":           0x013b,
+	"Copyright":        0x8298,
+}
+
+// metadataReport is what was found in an upload, and removed by re-encoding it
+type metadataReport struct {
+	Exif        bool              // has an EXIF block at all (may hold fields goexif doesn't name)
+	Orientation int               // EXIF orientation, 1 (or 0 if missing) is upright
+	Stripped    []string          // human readable names of what was removed
+	Kept        map[uint16]string // whitelisted EXIF fields to write back, tag id -> value
+}
+
+func (m metadataReport) hasMetadata() bool {
+	return len(m.Stripped) > 0
+}
+
+func (m metadataReport) rotated() bool {
+	return m.Orientation > 1
+}
+
+// String is the summary reported back to the uploader
+func (m metadataReport) String() string {
+	parts := []string{}
+	if m.hasMetadata() {
+		parts = append(parts, "removed "+strings.Join(m.Stripped, ", "))
+	}
+	if m.rotated() {
+		parts = append(parts, "rotated to match EXIF orientation")
+	}
+	if len(m.Kept) > 0 {
+		parts = append(parts, fmt.Sprintf("kept %v whitelisted field(s)", len(m.Kept)))
+	}
+	return strings.Join(parts, "; ")
+}
+
+// notable EXIF fields are reported by group, the rest only as a count
+var exifFieldGroups = map[exif.FieldName]string{
+	exif.Make:              "camera make/model",
+	exif.Model:             "camera make/model",
+	exif.DateTime:          "date taken",
+	exif.DateTimeOriginal:  "date taken",
+	exif.DateTimeDigitized: "date taken",
+	exif.Software:          "software",
+	exif.Artist:            "author/copyright",
+	exif.Copyright:         "author/copyright",
+	exif.ImageDescription:  "description",
+	exif.UserComment:       "description",
+}
+
+type exifWalker struct {
+	report *metadataReport
+	groups map[string]bool
+	other  int
+}
+
+func (ew *exifWalker) Walk(name exif.FieldName, tag *tiff.Tag) error {
+	field := string(name)
+
+	for _, keep := range ExifWhitelist {
+		id, ok := exifWhitelistable[keep]
+		if ok && keep == field && tag.Format() == tiff.StringVal {
+			if val, err := tag.StringVal(); err == nil && val != "" {
+				ew.report.Kept[id] = val
+				return nil
+			}
+		}
+	}
+
+	switch {
+	case strings.HasPrefix(field, "GPS"):
+		ew.groups["GPS location"] = true
+	case exifFieldGroups[name] != "":
+		ew.groups[exifFieldGroups[name]] = true
+	case name == exif.Orientation:
+		if v, err := tag.Int(0); err == nil {
+			ew.report.Orientation = v
+		}
+	case name == exif.ExifIFDPointer || name == exif.GPSInfoIFDPointer || name == exif.InteroperabilityIFDPointer:
+		// structure, not data
+	default:
+		ew.other++
+	}
+	return nil
+}
+
+// inspectMetadata lists the metadata carried by an uploaded image
+func inspectMetadata(file_bytes []byte) metadataReport {
+	report := metadataReport{Kept: map[uint16]string{}}
+
+	switch {
+	case bytes.HasPrefix(file_bytes, []byte("\xff\xd8")):
+		x, err := exif.Decode(bytes.NewReader(file_bytes))
+		if x != nil && (err == nil || !exif.IsCriticalError(err)) {
+			report.Exif = true
+			walker := &exifWalker{report: &report, groups: map[string]bool{}}
+			x.Walk(walker)
+			for group := range walker.groups {
+				report.Stripped = append(report.Stripped, group)
+			}
+			sort.Strings(report.Stripped)
+			if walker.other > 0 {
+				report.Stripped = append(report.Stripped, fmt.Sprintf("%v other EXIF fields", walker.other))
+			}
+		}
+		report.Stripped = append(report.Stripped, jpegSegments(file_bytes)...)
+
+	case bytes.HasPrefix(file_bytes, []byte("\x89PNG\r\n\x1a\n")):
+		report.Stripped = append(report.Stripped, pngChunks(file_bytes)...)
+
+	case isWebP(file_bytes):
+		report.Stripped, _ = webpMetadata(file_bytes)
+
+	case bytes.HasPrefix(file_bytes, []byte("GIF8")):
+		report.Stripped, _ = gifMetadata(file_bytes)
+	}
+
+	return report
+}
+
+// jpegSegments names the non-EXIF metadata segments in a jpeg
+func jpegSegments(b []byte) []string {
+	found := []string{}
+	seen := map[string]bool{}
+	add := func(name string) {
+		if !seen[name] {
+			seen[name] = true
+			found = append(found, name)
+		}
+	}
+
+	for i := 2; i+4 <= len(b) && b[i] == 0xff; {
+		marker := b[i+1]
+		if marker == 0xda { // start of scan, no metadata after this
+			break
+		}
+		length := int(binary.BigEndian.Uint16(b[i+2:]))
+		if length < 2 { // the length counts its own two bytes, anything less is corrupt
+			break
+		}
+		payload := b[min(i+4, len(b)):min(i+2+length, len(b))]
+
+		switch {
+		case marker == 0xe1 && bytes.HasPrefix(payload, []byte("http://ns.adobe.com/xap/")):
+			add("XMP")
+		case marker == 0xe2 && bytes.HasPrefix(payload, []byte("ICC_PROFILE")):
+			add("ICC profile")
+		case marker == 0xed:
+			add("IPTC/Photoshop")
+		case marker == 0xfe:
+			add("comment")
+		}
+		i += 2 + length
+	}
+	return found
+}
+
+// pngChunks names the metadata chunks in a png
+func pngChunks(b []byte) []string {
+	names := map[string]string{
+		"tEXt": "text", "zTXt": "text", "iTXt": "text",
+		"eXIf": "EXIF", "tIME": "timestamp", "iCCP": "ICC profile",
+	}
+	found := []string{}
+	seen := map[string]bool{}
+
+	for i := 8; i+8 <= len(b); {
+		length := int(binary.BigEndian.Uint32(b[i:]))
+		if name, ok := names[string(b[i+4:i+8])]; ok && !seen[name] {
+			seen[name] = true
+			found = append(found, name)
+		}
+		i += 12 + length
+	}
+	return found
+}
+
+// webp metadata chunks, id -> name
+var webpMetadataChunks = map[string]string{
+	"EXIF": "EXIF",
+	"XMP ": "XMP",
+	"ICCP": "ICC profile",
+}
+
+// webpMetadata names the metadata chunks in a webp and returns the file without
+// them, the image data (and every animation frame) is copied untouched
+func webpMetadata(b []byte) ([]string, []byte) {
+	found := []string{}
+	seen := map[string]bool{}
+	body := []byte("WEBP")
+
+	end := min(8+int(binary.LittleEndian.Uint32(b[4:])), len(b)) // anything after the RIFF is dropped
+	riffChunks(b[12:max(end, 12)], func(id string, chunk, payload []byte) bool {
+		if name, ok := webpMetadataChunks[id]; ok {
+			if !seen[name] {
+				seen[name] = true
+				found = append(found, name)
+			}
+			return true
+		}
+		if id == "VP8X" && len(chunk) > 8 {
+			chunk = append([]byte{}, chunk...)
+			chunk[8] &^= 0x20 | 0x08 | 0x04 // ICC, EXIF and XMP flags
+		}
+		body = append(body, chunk...)
+		return true
+	})
+
+	out := binary.LittleEndian.AppendUint32([]byte("RIFF"), uint32(len(body)))
+	return found, append(out, body...)
+}
+
+// gifMetadata names the comment and application extensions in a gif (other than
+// the animation loop count) and returns the file without them, frames are copied untouched
+func gifMetadata(b []byte) ([]string, []byte) {
+	found := []string{}
+	seen := map[string]bool{}
+	add := func(name string) {
+		if !seen[name] {
+			seen[name] = true
+			found = append(found, name)
+		}
+	}
+	if len(b) < 13 {
+		return found, b
+	}
+
+	i := 13
+	if b[10]&0x80 != 0 { // global color table
+		i += 3 << (b[10]&0x07 + 1)
+	}
+	out := append([]byte{}, b[:min(i, len(b))]...)
+
+	skipSubBlocks := func() {
+		for i < len(b) {
+			n := int(b[i])
+			i += 1 + n
+			if n == 0 {
+				return
+			}
+		}
+	}
+
+	for i < len(b) {
+		start := i
+		switch b[i] {
+		case 0x21: // extension: label, then data sub-blocks
+			label := byte(0)
+			if i+1 < len(b) {
+				label = b[i+1]
+			}
+			app := ""
+			if label == 0xff && i+14 <= len(b) && b[i+2] == 11 {
+				app = string(b[i+3 : i+14])
+			}
+			i += 2
+			skipSubBlocks()
+
+			switch {
+			case label == 0xfe:
+				add("comment")
+				continue
+			case label == 0xff && app == "XMP DataXMP":
+				add("XMP")
+				continue
+			case label == 0xff && app == "ICCRGBG1012":
+				add("ICC profile")
+				continue
+			case label == 0xff && app != "NETSCAPE2.0" && app != "ANIMEXTS1.0":
+				add("application data")
+				continue
+			}
+		case 0x2c: // image descriptor
+			if i+10 > len(b) {
+				i = len(b)
+				break
+			}
+			flags := b[i+9]
+			i += 10
+			if flags&0x80 != 0 { // local color table
+				i += 3 << (flags&0x07 + 1)
+			}
+			i++ // LZW minimum code size
+			skipSubBlocks()
+		default: // trailer, anything after it is dropped
+			return found, append(out, 0x3b)
+		}
+		out = append(out, b[start:min(i, len(b))]...)
+	}
+	return found, out
+}
+
+// stripContainerMetadata drops the metadata chunks of a webp or gif without re-encoding it
+func stripContainerMetadata(file_bytes []byte) []byte {
+	if isWebP(file_bytes) {
+		_, out := webpMetadata(file_bytes)
+		return out
+	}
+	_, out := gifMetadata(file_bytes)
+	return out
+}
+
+// decodeOriented decodes an image with its EXIF orientation applied
+func decodeOriented(file_bytes []byte) (image.Image, error) {
+	return imaging.Decode(bytes.NewReader(file_bytes), imaging.AutoOrientation(true))
+}
+
+// exifSegment builds a jpeg APP1 segment holding only the kept text fields
+func exifSegment(kept map[uint16]string) []byte {
+	if len(kept) == 0 {
+		return nil
+	}
+
+	ids := []uint16{}
+	for id := range kept {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] }) // IFD entries must be sorted
+
+	// little endian tiff: header, one IFD, then the strings it points to
+	le := binary.LittleEndian
+	ifd_size := 2 + 12*len(ids) + 4
+	data_offset := 8 + ifd_size
+
+	var ifd, data bytes.Buffer
+	binary.Write(&ifd, le, uint16(len(ids)))
+	for _, id := range ids {
+		val := append([]byte(kept[id]), 0)
+		binary.Write(&ifd, le, id)
+		binary.Write(&ifd, le, uint16(2)) // ASCII
+		binary.Write(&ifd, le, uint32(len(val)))
+		if len(val) <= 4 {
+			inline := make([]byte, 4)
+			copy(inline, val)
+			ifd.Write(inline)
+		} else {
+			binary.Write(&ifd, le, uint32(data_offset+data.Len()))
+			data.Write(val)
+			if data.Len()%2 == 1 {
+				data.WriteByte(0) // keep offsets word aligned
+			}
+		}
+	}
+	binary.Write(&ifd, le, uint32(0)) // no next IFD
+
+	var payload bytes.Buffer
+	payload.WriteString("Exif\x00\x00")
+	payload.WriteString("II*\x00")
+	binary.Write(&payload, le, uint32(8))
+	payload.Write(ifd.Bytes())
+	payload.Write(data.Bytes())
+
+	var seg bytes.Buffer
+	seg.Write([]byte{0xff, 0xe1})
+	binary.Write(&seg, binary.BigEndian, uint16(payload.Len()+2))
+	seg.Write(payload.Bytes())
+	return seg.Bytes()
+}
+
+// stripMetadata re-encodes an upload without its metadata (keeping whitelisted
+// EXIF fields in jpegs), returns the new bytes and mime type
+func stripMetadata(img image.Image, mime_type string, report metadataReport) ([]byte, string, error) {
+	var buf bytes.Buffer
+
+	if mime_type == "image/jpeg" {
+		err := imaging.Encode(&buf, img, imaging.JPEG, imaging.JPEGQuality(STRIPPED_JPEG_QUALITY))
+		if err != nil {
+			return nil, "", fmt.Errorf("error re-encoding jpeg: %w", err)
+		}
+		out := buf.Bytes()
+		if seg := exifSegment(report.Kept); seg != nil {
+			out = append(append(append([]byte{}, out[:2]...), seg...), out[2:]...) // right after SOI
+		}
+		return out, mime_type, nil
+	}
+
+	err := imaging.Encode(&buf, img, imaging.PNG)
+	if err != nil {
+		return nil, "", fmt.Errorf("error re-encoding png: %w", err)
+	}
+	return buf.Bytes(), "image/png", nil
+}
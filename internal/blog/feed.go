@@ -0,0 +1,184 @@
+package blog
+
+import (
+	// internal
+	"blog/internal/users"
+
+	// golang
+	"database/sql"
+	"encoding/xml"
+	"html/template"
+	"log"
+	"net/http"
+	"time"
+
+	// externals
+	"github.com/gorilla/sessions"
+)
+
+// number of newest pages listed in the feed
+const FEED_LENGTH = 20
+
+// rss 2.0, only the fields feed readers need
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title         string    `xml:"title"`
+	Link          string    `xml:"link"`
+	Description   string    `xml:"description"`
+	LastBuildDate string    `xml:"lastBuildDate,omitempty"`
+	Items         []rssItem `xml:"item"`
+}
+
+type rssItem struct {
+	Title       string  `xml:"title"`
+	Link        string  `xml:"link"`
+	GUID        rssGUID `xml:"guid"`
+	PubDate     string  `xml:"pubDate"`
+	Description string  `xml:"description"`
+}
+
+type rssGUID struct {
+	Value       string `xml:",chardata"`
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+}
+
+// siteURL is the scheme and host the request came in on, behind nginx the scheme comes from X-Forwarded-Proto
+func siteURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+// FeedHandler serves the newest listed pages as rss. scheduled pages only show up once their
+// post time has passed (and dated then), so readers are notified when a post goes live.
+// /feed?tag={name} only has the pages with that tag (or a tag under it).
+// feed readers have no session, so the feed needs the user's token: signed in users
+// opening /feed are redirected to their own /feed?token={token} url to subscribe to
+func FeedHandler(w http.ResponseWriter, r *http.Request, db *sql.DB, st *sessions.CookieStore) {
+	query := r.URL.Query()
+	if token := query.Get("token"); token != "" {
+		valid, err := users.FeedTokenValid(db, token)
+		if err != nil {
+			log.Printf("failed to check feed token: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if !valid {
+			http.Error(w, "Feed not found", http.StatusNotFound)
+			return
+		}
+	} else {
+		if !users.IsAuthed(r, st) {
+			RenderSplash(w, r)
+			return
+		}
+		username, err := users.GetCurrentUsername(r, st)
+		if err != nil {
+			http.Redirect(w, r, "/login", http.StatusSeeOther)
+			return
+		}
+		token, err := users.FeedToken(db, username)
+		if err != nil {
+			log.Printf("error getting feed token: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		query.Set("token", token)
+		http.Redirect(w, r, "/feed?"+query.Encode(), http.StatusSeeOther)
+		return
+	}
+
+	title, link, description := "OGsyn", "/", "Newest pages"
+	filter := listedFilter("p")
+	args := []interface{}{}
+	if tag := query.Get("tag"); tag != "" {
+		name, err := canonicalTag(db, tag)
+		if err != nil {
+			http.Error(w, "Tag not found", http.StatusNotFound)
+			return
+		}
+		title, link, description = "OGsyn - "+name, tagURL(name), "Newest pages tagged "+name
+		filter += " AND " + taggedFilter("p")
+		args = append(args, name)
+	}
+
+	rows, err := db.Query(`
+		SELECT p.id, p.title, p.display_title, p.content, p.post_time, p.level
+		FROM pages p
+		WHERE `+filter+`
+		ORDER BY p.post_time DESC
+		LIMIT ?`, append(args, FEED_LENGTH)...)
+	if err != nil {
+		log.Printf("failed to get pages for feed: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	var pages []BlogPage
+	for rows.Next() {
+		var p BlogPage
+		err := rows.Scan(&p.ID, &p.Title, &p.DisplayTitle, &p.Content, &p.PostTime, &p.Level)
+		if err != nil {
+			rows.Close()
+			log.Printf("failed to scan page for feed: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		pages = append(pages, p)
+	}
+	rows.Close()
+
+	site := siteURL(r)
+	feed := rssFeed{
+		Version: "2.0",
+		Channel: rssChannel{
+			Title:       title,
+			Link:        site + link,
+			Description: description,
+		},
+	}
+	if len(pages) > 0 {
+		feed.Channel.LastBuildDate = pages[0].PostTime.Format(time.RFC1123Z)
+	}
+
+	for i := range pages {
+		p := &pages[i]
+
+		// a feed url is easily shared, gated pages only get their teaser
+		var content template.HTML
+		if p.Level != users.PUBLIC_LEVEL {
+			lockPage(p)
+			content = p.ContentHTML
+		} else {
+			content, err = pageContentHTML(db, p)
+			if err != nil {
+				log.Printf("error rendering content of '%v' for feed: %v", p.Title, err)
+			}
+		}
+
+		link := site + p.URL()
+		feed.Channel.Items = append(feed.Channel.Items, rssItem{
+			Title:       p.DisplayTitle,
+			Link:        link,
+			GUID:        rssGUID{Value: link, IsPermaLink: true},
+			PubDate:     p.PostTime.Format(time.RFC1123Z),
+			Description: string(content),
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/rss+xml; charset=utf-8")
+	w.Write([]byte(xml.Header))
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	err = enc.Encode(feed)
+	if err != nil {
+		log.Printf("error writing feed: %v", err)
+	}
+}
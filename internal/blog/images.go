@@ -0,0 +1,548 @@
+package blog
+
+import (
+	// internal
+	"blog/internal/media"
+
+	// golang
+	"bytes"
+	"database/sql"
+	"fmt"
+	"html/template"
+	"image"
+	"image/png"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+
+	// externals
+	"github.com/disintegration/imaging"
+)
+
+const (
+	THUMBNAIL_SIZE        int = 300
+	THUMBNAIL_QUALITY     int = 80
+	VARIANT_QUALITY       int = 85
+	STRIPPED_JPEG_QUALITY int = 92 // re-encoded originals (metadata removed)
+
+	// kinds of rows in page_image_variants
+	VARIANT_ORIGINAL  string = "original"
+	VARIANT_THUMBNAIL string = "thumbnail"
+	VARIANT_WIDTH     string = "width"
+)
+
+// widths generated for srcset, widths larger than the original are skipped
+var VARIANT_WIDTHS = []int{480, 960, 1920}
+
+// encoders for derived images keyed by mime type, every type in variantMimeTypes is
+// generated for each width. a webp/avif encoder only needs to be added to both
+var variantEncoders = map[string]func(io.Writer, image.Image) error{
+	"image/jpeg": func(w io.Writer, img image.Image) error {
+		return imaging.Encode(w, img, imaging.JPEG, imaging.JPEGQuality(VARIANT_QUALITY))
+	},
+	"image/png": func(w io.Writer, img image.Image) error {
+		return imaging.Encode(w, img, imaging.PNG, imaging.PNGCompressionLevel(png.BestCompression))
+	},
+}
+
+var variantMimeTypes = []string{"image/jpeg"}
+
+// ImageVariant is a stored copy of a page image, match page_image_variants table
+type ImageVariant struct {
+	Kind     string
+	Width    int
+	Height   int
+	Hash     string
+	MimeType string
+}
+
+// ImageSource is one <source> of a <picture>, all widths of a single type
+type ImageSource struct {
+	MimeType string
+	SrcSet   string
+}
+
+// storedImage is an upload once it is in the media store, its thumbnail and
+// resized variants are made later by an image job (see jobs.go)
+type storedImage struct {
+	Name     string // uploaded file name
+	Hash     string
+	Variants []ImageVariant // only the original until the job runs
+	Metadata metadataReport
+	Animated bool // animated gif/webp, stored untouched
+	Focus    FocalPoint
+}
+
+// makeThumbnail returns a square jpeg thumbnail of img, cropped around focus
+func makeThumbnail(img image.Image, focus FocalPoint) ([]byte, error) {
+	// scale the short side to the thumbnail size, then crop the long side around the focal point
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	scale := max(float64(THUMBNAIL_SIZE)/float64(w), float64(THUMBNAIL_SIZE)/float64(h))
+	rw := max(THUMBNAIL_SIZE, int(float64(w)*scale+0.5))
+	rh := max(THUMBNAIL_SIZE, int(float64(h)*scale+0.5))
+	resized := imaging.Resize(img, rw, rh, imaging.Lanczos)
+
+	x := min(max(int(focus.X*float64(rw))-THUMBNAIL_SIZE/2, 0), rw-THUMBNAIL_SIZE)
+	y := min(max(int(focus.Y*float64(rh))-THUMBNAIL_SIZE/2, 0), rh-THUMBNAIL_SIZE)
+	thumb := imaging.Crop(resized, image.Rect(x, y, x+THUMBNAIL_SIZE, y+THUMBNAIL_SIZE))
+
+	var buf bytes.Buffer
+	err := imaging.Encode(&buf, thumb, imaging.JPEG, imaging.JPEGQuality(THUMBNAIL_QUALITY))
+	if err != nil {
+		return nil, fmt.Errorf("error encoding image for thumbnail: %w", err)
+	}
+
+	return buf.Bytes(), nil
+}
+
+func isOpaque(img image.Image) bool {
+	if o, ok := img.(interface{ Opaque() bool }); ok {
+		return o.Opaque()
+	}
+	return true
+}
+
+// makeVariants stores a resized copy of img for each width smaller than the original
+func makeVariants(ms *media.Store, img image.Image) ([]ImageVariant, error) {
+	mime_types := variantMimeTypes
+	if !isOpaque(img) {
+		mime_types = []string{"image/png"} // keep transparency
+	}
+
+	var variants []ImageVariant
+	for _, width := range VARIANT_WIDTHS {
+		if width >= img.Bounds().Dx() {
+			continue
+		}
+
+		resized := imaging.Resize(img, width, 0, imaging.Lanczos)
+
+		for _, mime_type := range mime_types {
+			var buf bytes.Buffer
+			err := variantEncoders[mime_type](&buf, resized)
+			if err != nil {
+				return nil, fmt.Errorf("error encoding %vw %v variant: %w", width, mime_type, err)
+			}
+
+			hash, err := ms.Put(&buf, mime_type)
+			if err != nil {
+				return nil, fmt.Errorf("error storing %vw %v variant: %w", width, mime_type, err)
+			}
+
+			variants = append(variants, ImageVariant{
+				Kind:     VARIANT_WIDTH,
+				Width:    resized.Bounds().Dx(),
+				Height:   resized.Bounds().Dy(),
+				Hash:     hash,
+				MimeType: mime_type,
+			})
+		}
+	}
+
+	return variants, nil
+}
+
+// storeImage saves an uploaded image. uploads carrying metadata are re-encoded
+// upright without it before being stored, animations keep their frames as uploaded
+func storeImage(ms *media.Store, file_bytes []byte, focus FocalPoint) (storedImage, error) {
+	stored := storedImage{Focus: focus}
+	mime_type := http.DetectContentType(file_bytes)
+	stored.Metadata = inspectMetadata(file_bytes)
+	stored.Animated = isAnimated(file_bytes)
+
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(file_bytes))
+	if err != nil {
+		return storedImage{}, fmt.Errorf("error decoding image: %w", err)
+	}
+	width, height := cfg.Width, cfg.Height
+
+	// nothing is stored with its metadata, so this full decode can't wait for the job.
+	// webp and gif keep theirs in separate chunks, which are dropped without re-encoding
+	if (mime_type == "image/webp" || mime_type == "image/gif") && stored.Metadata.hasMetadata() {
+		file_bytes = stripContainerMetadata(file_bytes)
+	} else if !stored.Animated && (stored.Metadata.Exif || stored.Metadata.hasMetadata() || stored.Metadata.rotated()) {
+		img, err := decodeOriented(file_bytes)
+		if err != nil {
+			return storedImage{}, fmt.Errorf("error decoding image: %w", err)
+		}
+		file_bytes, mime_type, err = stripMetadata(img, mime_type, stored.Metadata)
+		if err != nil {
+			return storedImage{}, err
+		}
+		width, height = img.Bounds().Dx(), img.Bounds().Dy()
+	}
+
+	stored.Hash, err = ms.Put(bytes.NewReader(file_bytes), mime_type)
+	if err != nil {
+		return storedImage{}, fmt.Errorf("error storing image: %w", err)
+	}
+
+	stored.Variants = []ImageVariant{{
+		Kind:     VARIANT_ORIGINAL,
+		Width:    width,
+		Height:   height,
+		Hash:     stored.Hash,
+		MimeType: mime_type,
+	}}
+
+	return stored, nil
+}
+
+// makeDerivatives stores the thumbnail of a decoded image and, when widths is set,
+// its resized variants (never for animations, resizing would only keep the first frame)
+func makeDerivatives(ms *media.Store, img image.Image, animated bool, focus FocalPoint, widths bool) ([]ImageVariant, error) {
+	thumb_bytes, err := makeThumbnail(img, focus)
+	if err != nil {
+		return nil, err
+	}
+
+	thumb, err := ms.Put(bytes.NewReader(thumb_bytes), "image/jpeg")
+	if err != nil {
+		return nil, fmt.Errorf("error storing thumbnail: %w", err)
+	}
+
+	variants := []ImageVariant{{
+		Kind:     VARIANT_THUMBNAIL,
+		Width:    THUMBNAIL_SIZE,
+		Height:   THUMBNAIL_SIZE,
+		Hash:     thumb,
+		MimeType: "image/jpeg",
+	}}
+
+	if widths && !animated {
+		resized, err := makeVariants(ms, img)
+		if err != nil {
+			return nil, err
+		}
+		variants = append(variants, resized...)
+	}
+	return variants, nil
+}
+
+// replaces the variants recorded for a page image
+func setImageVariants(tx *sql.Tx, pageID int64, source_hash string, variants []ImageVariant) error {
+	_, err := tx.Exec("DELETE FROM page_image_variants WHERE page_id = ? AND source_hash = ?", pageID, source_hash)
+	if err != nil {
+		return fmt.Errorf("failed to clear variants: %w", err)
+	}
+
+	for _, v := range variants {
+		_, err = tx.Exec(`
+			INSERT INTO page_image_variants (page_id, source_hash, kind, width, height, media_hash, mime_type)
+			VALUES (?, ?, ?, ?, ?, ?, ?)
+			ON CONFLICT DO NOTHING`,
+			pageID, source_hash, v.Kind, v.Width, v.Height, v.Hash, v.MimeType)
+		if err != nil {
+			return fmt.Errorf("failed to add %vw variant: %w", v.Width, err)
+		}
+	}
+	return nil
+}
+
+// addImageVariants records variants of a page image, replacing any of the same kind/width/type
+func addImageVariants(tx *sql.Tx, pageID int64, source_hash string, variants []ImageVariant) error {
+	for _, v := range variants {
+		_, err := tx.Exec(`
+			INSERT INTO page_image_variants (page_id, source_hash, kind, width, height, media_hash, mime_type)
+			VALUES (?, ?, ?, ?, ?, ?, ?)
+			ON CONFLICT DO UPDATE SET height = excluded.height, media_hash = excluded.media_hash`,
+			pageID, source_hash, v.Kind, v.Width, v.Height, v.Hash, v.MimeType)
+		if err != nil {
+			return fmt.Errorf("failed to add %vw variant: %w", v.Width, err)
+		}
+	}
+	return nil
+}
+
+func getImageVariants(db *sql.DB, pageID int64, source_hash string) ([]ImageVariant, error) {
+	rows, err := db.Query(`
+		SELECT kind, width, height, media_hash, mime_type
+		FROM page_image_variants
+		WHERE page_id = ? AND source_hash = ?
+		ORDER BY width`, pageID, source_hash)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var variants []ImageVariant
+	for rows.Next() {
+		var v ImageVariant
+		err := rows.Scan(&v.Kind, &v.Width, &v.Height, &v.Hash, &v.MimeType)
+		if err != nil {
+			return nil, err
+		}
+		variants = append(variants, v)
+	}
+	return variants, nil
+}
+
+// imageSources groups variants into srcsets by type, the original's type goes
+// last since the browser takes the first <source> it supports
+func imageSources(variants []ImageVariant) []ImageSource {
+	var original string
+	sets := map[string][]string{}
+	for _, v := range variants {
+		if v.Kind == VARIANT_THUMBNAIL {
+			continue
+		}
+		if v.Kind == VARIANT_ORIGINAL {
+			original = v.MimeType
+		}
+		sets[v.MimeType] = append(sets[v.MimeType], fmt.Sprintf("/media/%s %dw", v.Hash, v.Width))
+	}
+
+	var sources []ImageSource
+	for mime_type, set := range sets {
+		sources = append(sources, ImageSource{MimeType: mime_type, SrcSet: strings.Join(set, ", ")})
+	}
+	sort.Slice(sources, func(i, j int) bool {
+		if (sources[i].MimeType == original) != (sources[j].MimeType == original) {
+			return sources[j].MimeType == original
+		}
+		return sources[i].MimeType < sources[j].MimeType
+	})
+	return sources
+}
+
+// BackfillImageVariants generates variants for pages uploaded before they existed
+func BackfillImageVariants(db *sql.DB, ms *media.Store) error {
+	rows, err := db.Query(`
+		SELECT id, image FROM pages p
+		WHERE NOT EXISTS (SELECT 1 FROM page_image_variants v WHERE v.page_id = p.id AND v.source_hash = p.image)`)
+	if err != nil {
+		return fmt.Errorf("failed to get pages without variants: %w", err)
+	}
+
+	type pending struct {
+		id   int64
+		hash string
+	}
+	var pages []pending
+	for rows.Next() {
+		var p pending
+		if err := rows.Scan(&p.id, &p.hash); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan page: %w", err)
+		}
+		pages = append(pages, p)
+	}
+	rows.Close()
+
+	for _, p := range pages {
+		file_bytes, err := ms.ReadAll(p.hash)
+		if err != nil {
+			return fmt.Errorf("failed to read image for page %v: %w", p.id, err)
+		}
+
+		m, err := ms.Stat(p.hash)
+		if err != nil {
+			return fmt.Errorf("failed to stat image for page %v: %w", p.id, err)
+		}
+
+		img, err := decodeForThumbnail(file_bytes)
+		if err != nil {
+			return fmt.Errorf("failed to decode image for page %v: %w", p.id, err)
+		}
+
+		variants, err := makeDerivatives(ms, img, isAnimated(file_bytes), DEFAULT_FOCUS, true)
+		if err != nil {
+			return fmt.Errorf("failed to process image for page %v: %w", p.id, err)
+		}
+		variants = append(variants, ImageVariant{
+			Kind:     VARIANT_ORIGINAL,
+			Width:    img.Bounds().Dx(),
+			Height:   img.Bounds().Dy(),
+			Hash:     p.hash,
+			MimeType: m.MimeType,
+		})
+
+		tx, err := db.Begin()
+		if err != nil {
+			return fmt.Errorf("failed to begin transaction: %w", err)
+		}
+		err = setImageVariants(tx, p.id, p.hash, variants)
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to record variants for page %v: %w", p.id, err)
+		}
+		if err = tx.Commit(); err != nil {
+			return fmt.Errorf("failed to commit variants for page %v: %w", p.id, err)
+		}
+	}
+
+	return nil
+}
+
+//
+// Galleries (page_images)
+//
+
+// PageImage is one image of a page gallery, match page_images table
+type PageImage struct {
+	ID        int64
+	Position  int
+	Hash      string
+	Thumbnail string
+	Caption   string
+	AltText   string
+	Animated  bool
+	Focus     FocalPoint
+	Variants  []ImageVariant
+}
+
+func (i PageImage) ImageSources() []ImageSource {
+	return imageSources(i.Variants)
+}
+
+// readImageUploads runs every file in a multipart field through storeImage, in upload order
+func readImageUploads(r *http.Request, ms *media.Store, field string, focus FocalPoint) ([]storedImage, error) {
+	if r.MultipartForm == nil {
+		return nil, nil
+	}
+
+	var images []storedImage
+	for _, header := range r.MultipartForm.File[field] {
+		file, err := header.Open()
+		if err != nil {
+			return nil, fmt.Errorf("error opening '%v': %w", header.Filename, err)
+		}
+		err = validateImage(file, header.Filename)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		file_bytes, err := io.ReadAll(file)
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("error reading '%v': %w", header.Filename, err)
+		}
+
+		stored, err := storeImage(ms, file_bytes, focus)
+		if err != nil {
+			return nil, fmt.Errorf("error processing '%v': %w", header.Filename, err)
+		}
+		stored.Name = header.Filename
+		images = append(images, stored)
+	}
+	return images, nil
+}
+
+// metadataSummary tells the uploader what was stripped from each file (html for the htmx response)
+func metadataSummary(images []storedImage) string {
+	var b strings.Builder
+	for _, img := range images {
+		if summary := img.Metadata.String(); summary != "" {
+			fmt.Fprintf(&b, "<br>%s: %s", template.HTMLEscapeString(img.Name), template.HTMLEscapeString(summary))
+		}
+	}
+	return b.String()
+}
+
+// addPageImages appends images to the end of a page gallery
+func addPageImages(tx *sql.Tx, pageID int64, images []storedImage, alt_text string) error {
+	var next int
+	err := tx.QueryRow("SELECT COALESCE(MAX(position) + 1, 0) FROM page_images WHERE page_id = ?", pageID).Scan(&next)
+	if err != nil {
+		return fmt.Errorf("failed to get next image position: %w", err)
+	}
+
+	for i, img := range images {
+		_, err = tx.Exec(`
+			INSERT INTO page_images (page_id, position, media_hash, alt_text, animated, focal_x, focal_y)
+			VALUES (?, ?, ?, ?, ?, ?, ?)`, pageID, next+i, img.Hash, alt_text, img.Animated, img.Focus.X, img.Focus.Y)
+		if err != nil {
+			return fmt.Errorf("failed to add image: %w", err)
+		}
+
+		err = setImageVariants(tx, pageID, img.Hash, img.Variants)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func removePageImage(tx *sql.Tx, pageID int64, imageID int64) error {
+	var hash string
+	err := tx.QueryRow("DELETE FROM page_images WHERE id = ? AND page_id = ? RETURNING media_hash", imageID, pageID).Scan(&hash)
+	if err != nil {
+		return fmt.Errorf("failed to remove image %v: %w", imageID, err)
+	}
+
+	// the same file can be in a gallery twice, keep its variants while it is
+	_, err = tx.Exec(`
+		DELETE FROM page_image_variants
+		WHERE page_id = ? AND source_hash = ?
+		AND NOT EXISTS (SELECT 1 FROM page_images WHERE page_id = ? AND media_hash = ?)`,
+		pageID, hash, pageID, hash)
+	if err != nil {
+		return fmt.Errorf("failed to remove variants of image %v: %w", imageID, err)
+	}
+	return nil
+}
+
+// syncCoverImage points pages.image/thumbnail at the first image of the gallery (or
+// the first video poster for video only pages) and flags pages with any animated
+// image, the home page only reads those columns
+func syncCoverImage(tx *sql.Tx, pageID int64) error {
+	_, err := tx.Exec(`
+		UPDATE pages
+		SET image = COALESCE((
+				SELECT media_hash FROM page_images
+				WHERE page_id = pages.id
+				ORDER BY position LIMIT 1), ''),
+			thumbnail = COALESCE((
+				SELECT v.media_hash FROM page_images i
+				JOIN page_image_variants v ON v.page_id = i.page_id AND v.source_hash = i.media_hash
+				WHERE i.page_id = pages.id AND v.kind = ?
+				ORDER BY i.position LIMIT 1), (
+				SELECT poster_thumbnail FROM page_videos
+				WHERE page_id = pages.id AND poster_thumbnail != ''
+				ORDER BY position LIMIT 1), ''),
+			animated = EXISTS (
+				SELECT 1 FROM page_images
+				WHERE page_id = pages.id AND animated = 1)
+		WHERE id = ?`, VARIANT_THUMBNAIL, pageID)
+	if err != nil {
+		return fmt.Errorf("failed to update cover image: %w", err)
+	}
+	return nil
+}
+
+func getPageImages(db *sql.DB, pageID int64) ([]PageImage, error) {
+	rows, err := db.Query(`
+		SELECT id, position, media_hash, caption, alt_text, animated, focal_x, focal_y
+		FROM page_images
+		WHERE page_id = ?
+		ORDER BY position`, pageID)
+	if err != nil {
+		return nil, err
+	}
+
+	var images []PageImage
+	for rows.Next() {
+		var img PageImage
+		err := rows.Scan(&img.ID, &img.Position, &img.Hash, &img.Caption, &img.AltText, &img.Animated, &img.Focus.X, &img.Focus.Y)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		images = append(images, img)
+	}
+	rows.Close()
+
+	for i := range images {
+		images[i].Variants, err = getImageVariants(db, pageID, images[i].Hash)
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range images[i].Variants {
+			if v.Kind == VARIANT_THUMBNAIL {
+				images[i].Thumbnail = v.Hash
+			}
+		}
+	}
+	return images, nil
+}
@@ -0,0 +1,164 @@
+package blog
+
+import (
+	// internal
+	"blog/internal/jobs"
+	"blog/internal/media"
+
+	// golang
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+)
+
+// background jobs, registered on the queue by RegisterJobs
+const (
+	JOB_IMAGE_DERIVATIVES = "image_derivatives"
+	JOB_POSTER_THUMBNAIL  = "poster_thumbnail"
+)
+
+// imageJob makes the thumbnail (and resized variants if Variants is set) of a page image
+type imageJob struct {
+	PageID   int64
+	Hash     string
+	Variants bool
+}
+
+// posterJob makes the thumbnail of a video poster
+type posterJob struct {
+	VideoID int64
+}
+
+func RegisterJobs(q *jobs.Queue, db *sql.DB, ms *media.Store) {
+	q.Register(JOB_IMAGE_DERIVATIVES, func(ctx context.Context, payload []byte) error {
+		var job imageJob
+		if err := json.Unmarshal(payload, &job); err != nil {
+			return fmt.Errorf("invalid image job: %w", err)
+		}
+		return runImageJob(db, ms, job)
+	})
+
+	q.Register(JOB_POSTER_THUMBNAIL, func(ctx context.Context, payload []byte) error {
+		var job posterJob
+		if err := json.Unmarshal(payload, &job); err != nil {
+			return fmt.Errorf("invalid poster job: %w", err)
+		}
+		return runPosterJob(db, ms, job)
+	})
+}
+
+// enqueueImageJobs queues derivative generation for newly added page images
+func enqueueImageJobs(tx *sql.Tx, q *jobs.Queue, pageID int64, images []storedImage, owner string) ([]int64, error) {
+	var ids []int64
+	for _, img := range images {
+		id, err := q.EnqueueTx(tx, JOB_IMAGE_DERIVATIVES, imageJob{PageID: pageID, Hash: img.Hash, Variants: true}, owner)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func runImageJob(db *sql.DB, ms *media.Store, job imageJob) error {
+	// the focal point is read now so the latest edit wins
+	var focus FocalPoint
+	err := db.QueryRow(`
+		SELECT focal_x, focal_y FROM page_images
+		WHERE page_id = ? AND media_hash = ?
+		ORDER BY position LIMIT 1`, job.PageID, job.Hash).Scan(&focus.X, &focus.Y)
+	if err == sql.ErrNoRows {
+		return nil // removed before it was processed
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get image: %w", err)
+	}
+
+	file_bytes, err := ms.ReadAll(job.Hash)
+	if err != nil {
+		return fmt.Errorf("failed to read image: %w", err)
+	}
+
+	img, err := decodeForThumbnail(file_bytes)
+	if err != nil {
+		return fmt.Errorf("failed to decode image: %w", err)
+	}
+
+	variants, err := makeDerivatives(ms, img, isAnimated(file_bytes), focus, job.Variants)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var exists bool
+	err = tx.QueryRow("SELECT EXISTS(SELECT 1 FROM page_images WHERE page_id = ? AND media_hash = ?)", job.PageID, job.Hash).Scan(&exists)
+	if err != nil || !exists {
+		return err
+	}
+
+	err = addImageVariants(tx, job.PageID, job.Hash, variants)
+	if err != nil {
+		return err
+	}
+
+	err = syncCoverImage(tx, job.PageID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func runPosterJob(db *sql.DB, ms *media.Store, job posterJob) error {
+	var pageID int64
+	var poster string
+	err := db.QueryRow("SELECT page_id, poster FROM page_videos WHERE id = ?", job.VideoID).Scan(&pageID, &poster)
+	if err == sql.ErrNoRows {
+		return nil // removed before it was processed
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get video: %w", err)
+	}
+	if poster == "" {
+		return nil // poster removed before it was processed
+	}
+
+	file_bytes, err := ms.ReadAll(poster)
+	if err != nil {
+		return fmt.Errorf("failed to read poster: %w", err)
+	}
+
+	img, err := decodeForThumbnail(file_bytes)
+	if err != nil {
+		return fmt.Errorf("failed to decode poster: %w", err)
+	}
+
+	variants, err := makeDerivatives(ms, img, false, DEFAULT_FOCUS, false)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("UPDATE page_videos SET poster_thumbnail = ? WHERE id = ? AND poster = ?", variants[0].Hash, job.VideoID, poster)
+	if err != nil {
+		return fmt.Errorf("failed to set poster thumbnail: %w", err)
+	}
+
+	err = syncCoverImage(tx, pageID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,91 @@
+package blog
+
+import (
+	// internal
+	"blog/internal/users"
+
+	// golang
+	"database/sql"
+	"log"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	// externals
+	"github.com/gorilla/sessions"
+)
+
+// longest teaser shown in place of a gated page's content, in characters
+const TEASER_LENGTH = 300
+
+// canReadPage reports whether the current user has the access level of a page, admins
+// and the page's uploader always do
+func canReadPage(r *http.Request, db *sql.DB, st *sessions.CookieStore, level string, uploader string) bool {
+	if level == "" || level == users.PUBLIC_LEVEL || users.IsAdmin(r, st) {
+		return true
+	}
+
+	username, err := users.GetCurrentUsername(r, st)
+	if err != nil || username == "" {
+		return false
+	}
+	if username == uploader {
+		return true
+	}
+
+	has, err := users.HasSubscriptionLevel(db, username, level)
+	if err != nil {
+		log.Printf("error checking '%v' subscription of '%v': %v", level, username, err)
+		return false
+	}
+	return has
+}
+
+// teaser is the start of a gated page's content, its first paragraph cut to TEASER_LENGTH
+func teaser(content string) string {
+	content = strings.ReplaceAll(content, "\r\n", "\n")
+	if i := strings.Index(content, "\n\n"); i != -1 {
+		content = content[:i]
+	}
+	if utf8.RuneCountInString(content) <= TEASER_LENGTH {
+		return content
+	}
+
+	runes := []rune(content)[:TEASER_LENGTH]
+	if i := strings.LastIndexAny(string(runes), " \n"); i > 0 {
+		return string(runes)[:i] + "..."
+	}
+	return string(runes) + "..."
+}
+
+// lockPage cuts a page down to what users without its access level see, the teaser and
+// the cover image. media hashes of the rest are left out of the page
+func lockPage(p *BlogPage) {
+	p.Content = teaser(p.Content)
+	html, err := renderMarkdown(p.Content)
+	if err != nil {
+		log.Printf("error rendering teaser of '%v': %v", p.Title, err)
+	}
+	p.ContentHTML = html
+
+	if len(p.Images) > 1 {
+		p.Images = p.Images[:1]
+	}
+	p.Videos = nil
+	p.Comments = nil
+}
+
+// formLevel reads the access level picked on the upload/edit form, falling back to current
+func formLevel(r *http.Request, db *sql.DB, current string) (string, bool) {
+	level := r.FormValue("level")
+	if level == "" {
+		return current, true
+	}
+
+	exists, err := users.LevelExists(db, level)
+	if err != nil {
+		log.Printf("error checking level '%v': %v", level, err)
+		return "", false
+	}
+	return level, exists
+}
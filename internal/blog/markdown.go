@@ -0,0 +1,87 @@
+package blog
+
+import (
+	// golang
+	"bytes"
+	"database/sql"
+	"fmt"
+	"html/template"
+	"regexp"
+
+	// externals
+	"github.com/microcosm-cc/bluemonday"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/extension"
+	"github.com/yuin/goldmark/renderer/html"
+)
+
+// page content is markdown (github flavoured), single line breaks are kept as they
+// were when content was shown as plain text
+var markdown = goldmark.New(
+	goldmark.WithExtensions(
+		extension.NewTable(extension.WithTableCellAlignMethod(extension.TableCellAlignAttribute)),
+		extension.Strikethrough,
+		extension.Linkify,
+		extension.TaskList,
+	),
+	goldmark.WithRendererOptions(html.WithHardWraps()),
+)
+
+// contentPolicy is the allowlist rendered content is sanitized with, raw html in the
+// markdown is dropped by goldmark before this and anything else not listed is stripped
+var contentPolicy = func() *bluemonday.Policy {
+	p := bluemonday.NewPolicy()
+
+	p.AllowElements("p", "br", "hr", "h1", "h2", "h3", "h4", "h5", "h6",
+		"strong", "em", "del", "blockquote", "pre", "code",
+		"ul", "ol", "li", "table", "thead", "tbody", "tr", "th", "td")
+	p.AllowAttrs("start").Matching(bluemonday.Integer).OnElements("ol")
+	p.AllowAttrs("class").Matching(regexp.MustCompile(`^language-[\w+-]+$`)).OnElements("code")
+	p.AllowAttrs("align").Matching(regexp.MustCompile(`^(left|center|right)$`)).OnElements("th", "td")
+	p.AllowAttrs("checked", "disabled").OnElements("input")
+	p.AllowAttrs("type").Matching(regexp.MustCompile(`^checkbox$`)).OnElements("input")
+
+	// links and images, external links get rel="nofollow noopener" and open in a new tab
+	p.AllowStandardURLs()
+	p.RequireNoFollowOnLinks(false) // set by AllowStandardURLs, links within the blog don't need it
+	p.AllowAttrs("href", "title").OnElements("a")
+	p.AllowAttrs("src", "alt", "title").OnElements("img")
+	p.RequireNoFollowOnFullyQualifiedLinks(true)
+	p.AddTargetBlankToFullyQualifiedLinks(true)
+
+	return p
+}()
+
+func renderMarkdown(content string) (template.HTML, error) {
+	var buf bytes.Buffer
+	err := markdown.Convert([]byte(content), &buf)
+	if err != nil {
+		return "", fmt.Errorf("failed to render markdown: %w", err)
+	}
+	return template.HTML(contentPolicy.SanitizeBytes(buf.Bytes())), nil
+}
+
+// pageContentHTML returns the rendered content of a page, rendering and caching it in
+// pages.content_html if an edit cleared it
+func pageContentHTML(db *sql.DB, p *BlogPage) (template.HTML, error) {
+	var cached string
+	err := db.QueryRow("SELECT content_html FROM pages WHERE id = ?", p.ID).Scan(&cached)
+	if err != nil {
+		return "", fmt.Errorf("failed to get rendered content: %w", err)
+	}
+	if cached != "" || p.Content == "" {
+		return template.HTML(cached), nil
+	}
+
+	rendered, err := renderMarkdown(p.Content)
+	if err != nil {
+		return "", err
+	}
+
+	// only cache if the content wasn't changed since it was read
+	_, err = db.Exec("UPDATE pages SET content_html = ? WHERE id = ? AND content = ?", string(rendered), p.ID, p.Content)
+	if err != nil {
+		return "", fmt.Errorf("failed to cache rendered content: %w", err)
+	}
+	return rendered, nil
+}
@@ -0,0 +1,272 @@
+package blog
+
+import (
+	// internal
+	"blog/internal/users"
+
+	// golang
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	// externals
+	"github.com/gorilla/sessions"
+)
+
+// Revision is a saved version of a page, match page_revisions table
+type Revision struct {
+	ID           int64
+	PageID       int64
+	Title        string
+	DisplayTitle string
+	Content      string
+	Tags         string // space separated, sorted
+	Image        string // cover image hash
+	Editor       string
+	Created      time.Time
+
+	// compared to the revision before it, set for the history view
+	Diff         []DiffLine
+	TitleChanged bool
+	TagsChanged  bool
+	ImageChanged bool
+	Previous     *Revision
+}
+
+// saveRevision records the current state of a page, call in the transaction that changed it
+func saveRevision(tx *sql.Tx, pageID int64, editor string) error {
+	_, err := tx.Exec(`
+		INSERT INTO page_revisions (page_id, title, display_title, content, tags, image, editor)
+		SELECT id, title, display_title, content,
+			COALESCE((
+				SELECT group_concat(name, ' ') FROM (
+					SELECT t.name FROM page_tags pt JOIN tags t ON t.id = pt.tag_id
+					WHERE pt.page_id = pages.id ORDER BY t.name)), ''),
+			image, ?
+		FROM pages WHERE id = ?`, editor, pageID)
+	if err != nil {
+		return fmt.Errorf("failed to save revision: %w", err)
+	}
+	return nil
+}
+
+// getRevisions returns a page's revisions newest first, each compared to the one before it
+func getRevisions(db *sql.DB, pageID int64) ([]Revision, error) {
+	rows, err := db.Query(`
+		SELECT id, page_id, title, display_title, content, tags, image, editor, created
+		FROM page_revisions
+		WHERE page_id = ?
+		ORDER BY id DESC`, pageID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var revisions []Revision
+	for rows.Next() {
+		var rev Revision
+		err := rows.Scan(&rev.ID, &rev.PageID, &rev.Title, &rev.DisplayTitle, &rev.Content, &rev.Tags, &rev.Image, &rev.Editor, &rev.Created)
+		if err != nil {
+			return nil, err
+		}
+		revisions = append(revisions, rev)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := 0; i+1 < len(revisions); i++ {
+		rev, prev := &revisions[i], &revisions[i+1]
+		rev.Previous = prev
+		rev.TitleChanged = rev.DisplayTitle != prev.DisplayTitle
+		rev.TagsChanged = rev.Tags != prev.Tags
+		rev.ImageChanged = rev.Image != prev.Image
+		if rev.Content != prev.Content {
+			rev.Diff = diffLines(prev.Content, rev.Content)
+		}
+	}
+	return revisions, nil
+}
+
+// restoreCoverImage moves an old cover image back to the front of the gallery, if it is still there
+func restoreCoverImage(tx *sql.Tx, pageID int64, hash string) error {
+	rows, err := tx.Query("SELECT id, media_hash FROM page_images WHERE page_id = ? ORDER BY position", pageID)
+	if err != nil {
+		return err
+	}
+	var ids []int64
+	cover := -1
+	for rows.Next() {
+		var id int64
+		var media_hash string
+		if err := rows.Scan(&id, &media_hash); err != nil {
+			rows.Close()
+			return err
+		}
+		if media_hash == hash && cover == -1 {
+			cover = len(ids)
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+
+	if cover <= 0 {
+		return nil // gone, or already the cover
+	}
+
+	order := append([]int64{ids[cover]}, ids[:cover]...)
+	order = append(order, ids[cover+1:]...)
+	for i, id := range order {
+		_, err = tx.Exec("UPDATE page_images SET position = ? WHERE id = ?", i, id)
+		if err != nil {
+			return err
+		}
+	}
+	return syncCoverImage(tx, pageID)
+}
+
+func PageHistory(w http.ResponseWriter, r *http.Request, db *sql.DB, st *sessions.CookieStore) {
+	if !users.IsUploader(r, st) && !users.IsAdmin(r, st) {
+		log.Printf("non uploader attempted to view page history: %v", r.Host)
+		RenderTemplate(w, r, "NotFound", nil, st)
+		return
+	}
+
+	pageID, err := pathID(r.URL.Path, "/page-history/")
+	if err != nil {
+		RenderTemplate(w, r, "NotFound", nil, st)
+		return
+	}
+
+	pg, err := getPageFromDB(pageID, db)
+	if err != nil {
+		log.Printf("error getting page %v: %v", pageID, err)
+		RenderTemplate(w, r, "NotFound", nil, st)
+		return
+	}
+
+	if pg.Status == PAGE_DRAFT && !canSeeDraft(r, st, pg.Uploader) {
+		RenderTemplate(w, r, "NotFound", nil, st)
+		return
+	}
+
+	revisions, err := getRevisions(db, pg.ID)
+	if err != nil {
+		log.Printf("error getting revisions of '%v': %v", pg.Title, err)
+		RenderTemplate(w, r, "NotFound", nil, st)
+		return
+	}
+
+	data := map[string]interface{}{
+		"Page":      pg,
+		"Revisions": revisions,
+	}
+
+	RenderTemplate(w, r, "Page History", data, st)
+}
+
+// RestoreRevisionHandler puts a page's content, titles, tags and cover image back to
+// a saved revision, recorded as a new revision
+func RestoreRevisionHandler(w http.ResponseWriter, r *http.Request, db *sql.DB, st *sessions.CookieStore) {
+	if !users.IsUploader(r, st) {
+		w.Write([]byte("Unauthorized access"))
+		return
+	}
+
+	revisionID, err := strconv.ParseInt(r.FormValue("revision"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid revision", http.StatusBadRequest)
+		return
+	}
+
+	editor, err := users.GetCurrentUsername(r, st)
+	if err != nil {
+		w.Write([]byte("Unrecognized user"))
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		w.Write([]byte("Database error"))
+		return
+	}
+	defer tx.Rollback()
+
+	var rev Revision
+	var uploader, current_title, status string
+	err = tx.QueryRow(`
+		SELECT r.id, r.page_id, r.title, r.display_title, r.content, r.tags, r.image, p.uploader, p.title, p.status
+		FROM page_revisions r JOIN pages p ON p.id = r.page_id
+		WHERE r.id = ?`, revisionID).
+		Scan(&rev.ID, &rev.PageID, &rev.Title, &rev.DisplayTitle, &rev.Content, &rev.Tags, &rev.Image, &uploader, &current_title, &status)
+	if err != nil {
+		w.Write([]byte("Revision not found"))
+		return
+	}
+
+	if uploader != editor && !users.IsAdmin(r, st) {
+		w.Write([]byte("Insufficient permissions to edit page"))
+		return
+	}
+
+	// revisions from before tags were normalized go through the same checks as the edit form
+	tags, err := parseTags(rev.Tags)
+	if err != nil {
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	taken, err := slugTaken(tx, rev.Title, rev.PageID)
+	if err != nil || taken {
+		w.Write([]byte("Title already in use"))
+		return
+	}
+
+	_, err = tx.Exec("UPDATE pages SET title = ?, display_title = ?, content = ?, content_html = '' WHERE id = ?",
+		rev.Title, rev.DisplayTitle, rev.Content, rev.PageID)
+	if err != nil {
+		log.Printf("error restoring revision %v: %v", rev.ID, err)
+		w.Write([]byte("Error restoring revision"))
+		return
+	}
+
+	if status == PAGE_PUBLISHED {
+		err = renameSlug(tx, rev.PageID, current_title, rev.Title)
+		if err != nil {
+			log.Printf("error recording old title of '%v': %v", current_title, err)
+			w.Write([]byte("Error restoring revision"))
+			return
+		}
+	}
+
+	err = setPageTags(tx, rev.PageID, tags)
+	if err != nil {
+		log.Printf("error restoring tags of revision %v: %v", rev.ID, err)
+		w.Write([]byte("Error restoring revision"))
+		return
+	}
+
+	err = restoreCoverImage(tx, rev.PageID, rev.Image)
+	if err != nil {
+		log.Printf("error restoring cover image of revision %v: %v", rev.ID, err)
+		w.Write([]byte("Error restoring revision"))
+		return
+	}
+
+	err = saveRevision(tx, rev.PageID, editor)
+	if err != nil {
+		log.Printf("error saving restored revision: %v", err)
+		w.Write([]byte("Error restoring revision"))
+		return
+	}
+
+	if err = tx.Commit(); err != nil {
+		w.Write([]byte("Error saving changes"))
+		return
+	}
+
+	w.Write([]byte(fmt.Sprintf(`Restored revision %v, <a href="/page-history/%v">reload history</a>`, rev.ID, rev.PageID)))
+}
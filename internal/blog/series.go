@@ -0,0 +1,496 @@
+package blog
+
+import (
+	// internal
+	"blog/internal/users"
+
+	// golang
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	// externals
+	"github.com/gorilla/sessions"
+)
+
+// a series is an ordered list of pages (a devlog, a tutorial in parts...). the order is
+// kept in series_pages.position, not taken from post times, so backdating a page doesn't
+// move it. a page is in at most one series
+
+const MAX_SERIES_TITLE_LENGTH = 100
+
+var errUnknownSeries = errors.New("series not found")
+
+// Series matches the series table, Pages is only filled for the series page
+type Series struct {
+	ID          int64
+	Title       string
+	Description string
+	Creator     string
+	PageCount   int
+	Pages       []BlogPage
+}
+
+// SeriesPart is where a page sits in its series, Part is 0 when the page isn't listed
+// for the current user (e.g. an unlisted page opened by its link)
+type SeriesPart struct {
+	Series Series
+	Part   int
+	Total  int
+	Prev   *BlogPage
+	Next   *BlogPage
+}
+
+// getAllSeries returns every series by title, with the number of pages in each
+func getAllSeries(db *sql.DB) ([]Series, error) {
+	rows, err := db.Query(`
+		SELECT s.id, s.title, s.description, s.creator, COUNT(sp.page_id)
+		FROM series s
+		LEFT JOIN series_pages sp ON sp.series_id = s.id
+		GROUP BY s.id
+		ORDER BY s.title COLLATE NOCASE`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get series: %w", err)
+	}
+	defer rows.Close()
+
+	all := []Series{}
+	for rows.Next() {
+		var s Series
+		err := rows.Scan(&s.ID, &s.Title, &s.Description, &s.Creator, &s.PageCount)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan series: %w", err)
+		}
+		all = append(all, s)
+	}
+	return all, rows.Err()
+}
+
+func getSeries(db *sql.DB, seriesID int64) (*Series, error) {
+	var s Series
+	err := db.QueryRow("SELECT id, title, description, creator FROM series WHERE id = ?", seriesID).
+		Scan(&s.ID, &s.Title, &s.Description, &s.Creator)
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// getSeriesPages returns the pages of a series in order, drafts are never listed and
+// scheduled/unlisted pages only when show_hidden
+func getSeriesPages(db *sql.DB, seriesID int64, show_hidden bool) ([]BlogPage, error) {
+	rows, err := db.Query(`
+		SELECT p.id, p.title, p.display_title, p.post_time, p.thumbnail, IFNULL(p.unlisted, 0), p.level
+		FROM series_pages sp
+		JOIN pages p ON p.id = sp.page_id
+		WHERE sp.series_id = ? AND `+visibleFilter("p", show_hidden)+`
+		ORDER BY sp.position, p.id`, seriesID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get pages of series %v: %w", seriesID, err)
+	}
+	defer rows.Close()
+
+	pages := []BlogPage{}
+	for rows.Next() {
+		var p BlogPage
+		err := rows.Scan(&p.ID, &p.Title, &p.DisplayTitle, &p.PostTime, &p.Thumbnail, &p.Unlisted, &p.Level)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan page of series %v: %w", seriesID, err)
+		}
+		pages = append(pages, p)
+	}
+	return pages, rows.Err()
+}
+
+// pageSeriesID returns the id of the series a page is in, 0 for none
+func pageSeriesID(db *sql.DB, pageID int64) (int64, error) {
+	var seriesID int64
+	err := db.QueryRow("SELECT series_id FROM series_pages WHERE page_id = ?", pageID).Scan(&seriesID)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return seriesID, err
+}
+
+// pageSeriesPart returns the part a page is of its series with the pages around it,
+// nil if the page isn't in a series
+func pageSeriesPart(db *sql.DB, pageID int64, show_hidden bool) (*SeriesPart, error) {
+	seriesID, err := pageSeriesID(db, pageID)
+	if err != nil || seriesID == 0 {
+		return nil, err
+	}
+
+	series, err := getSeries(db, seriesID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get series %v: %w", seriesID, err)
+	}
+	pages, err := getSeriesPages(db, seriesID, show_hidden)
+	if err != nil {
+		return nil, err
+	}
+
+	part := &SeriesPart{Series: *series, Total: len(pages)}
+	for i := range pages {
+		if pages[i].ID != pageID {
+			continue
+		}
+		part.Part = i + 1
+		if i > 0 {
+			part.Prev = &pages[i-1]
+		}
+		if i < len(pages)-1 {
+			part.Next = &pages[i+1]
+		}
+	}
+	return part, nil
+}
+
+// setPageSeries moves a page into a series as its last part, or out of its series when
+// seriesID is 0. a page already in the series keeps its place
+func setPageSeries(tx *sql.Tx, pageID int64, seriesID int64) error {
+	if seriesID == 0 {
+		_, err := tx.Exec("DELETE FROM series_pages WHERE page_id = ?", pageID)
+		return err
+	}
+
+	var exists bool
+	err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM series WHERE id = ?)", seriesID).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return errUnknownSeries
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO series_pages (page_id, series_id, position)
+		SELECT ?1, ?2, IFNULL(MAX(position), 0) + 1 FROM series_pages WHERE series_id = ?2
+		ON CONFLICT (page_id) DO UPDATE SET
+			series_id = excluded.series_id,
+			position = excluded.position
+		WHERE series_pages.series_id != excluded.series_id`, pageID, seriesID)
+	if err != nil {
+		return fmt.Errorf("failed to add page %v to series %v: %w", pageID, seriesID, err)
+	}
+	return nil
+}
+
+// formSeries reads the series picked on the upload/edit form, 0 for none
+func formSeries(r *http.Request) int64 {
+	seriesID, _ := strconv.ParseInt(r.FormValue("series"), 10, 64)
+	return seriesID
+}
+
+// seriesForm reads and checks the title and description of the series forms
+func seriesForm(r *http.Request) (string, string, bool) {
+	title := strings.TrimSpace(r.FormValue("title"))
+	description := strings.TrimSpace(r.FormValue("description"))
+	return title, description, title != "" && len([]rune(title)) <= MAX_SERIES_TITLE_LENGTH
+}
+
+//
+// Series pages
+//
+
+func SeriesIndexPage(w http.ResponseWriter, r *http.Request, db *sql.DB, st *sessions.CookieStore) {
+	if !users.IsAuthed(r, st) {
+		RenderSplash(w, r)
+		return
+	}
+
+	all, err := getAllSeries(db)
+	if err != nil {
+		log.Printf("error getting series: %v", err)
+	}
+
+	RenderTemplate(w, r, "All Series", all, st)
+}
+
+func SeriesPage(w http.ResponseWriter, r *http.Request, db *sql.DB, st *sessions.CookieStore) {
+	if !users.IsAuthed(r, st) {
+		RenderSplash(w, r)
+		return
+	}
+
+	seriesID, err := pathID(r.URL.Path, "/series/")
+	if err != nil {
+		RenderTemplate(w, r, "NotFound", nil, st)
+		return
+	}
+
+	series, err := getSeries(db, seriesID)
+	if err != nil {
+		log.Printf("error getting series %v: %v", seriesID, err)
+		RenderTemplate(w, r, "NotFound", nil, st)
+		return
+	}
+
+	series.Pages, err = getSeriesPages(db, seriesID, canSeeHidden(r, st))
+	if err != nil {
+		log.Printf("error getting pages of series %v: %v", seriesID, err)
+	}
+
+	RenderTemplate(w, r, "Series", series, st)
+}
+
+//
+// Series management (htmx, uploaders)
+//
+
+func AddSeriesHandler(w http.ResponseWriter, r *http.Request, db *sql.DB, st *sessions.CookieStore) {
+	if !users.IsUploader(r, st) {
+		w.Write([]byte("Unauthorized access"))
+		return
+	}
+
+	username, err := users.GetCurrentUsername(r, st)
+	if err != nil {
+		w.Write([]byte("Unrecognized user"))
+		return
+	}
+
+	title, description, ok := seriesForm(r)
+	if !ok {
+		w.Write([]byte(fmt.Sprintf("Series titles must be 1-%d characters", MAX_SERIES_TITLE_LENGTH)))
+		return
+	}
+
+	result, err := db.Exec("INSERT INTO series (title, description, creator) VALUES (?, ?, ?)", title, description, username)
+	if err != nil {
+		log.Printf("failed to add series '%v': %v", title, err)
+		w.Write([]byte("Series title already in use"))
+		return
+	}
+	seriesID, err := result.LastInsertId()
+	if err != nil {
+		w.Write([]byte("Error adding series"))
+		return
+	}
+
+	w.Header().Set("HX-Redirect", fmt.Sprintf("/series/%d", seriesID))
+}
+
+func EditSeriesHandler(w http.ResponseWriter, r *http.Request, db *sql.DB, st *sessions.CookieStore) {
+	if !users.IsUploader(r, st) {
+		w.Write([]byte("Unauthorized access"))
+		return
+	}
+
+	seriesID, err := strconv.ParseInt(r.FormValue("series_id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid series", http.StatusBadRequest)
+		return
+	}
+
+	// only the series' creator or an admin can change it
+	var creator string
+	err = db.QueryRow("SELECT creator FROM series WHERE id = ?", seriesID).Scan(&creator)
+	if err == sql.ErrNoRows {
+		w.Write([]byte("Series not found"))
+		return
+	}
+	if err != nil {
+		log.Printf("failed to get series %v: %v", seriesID, err)
+		w.Write([]byte("Database error"))
+		return
+	}
+	username, err := users.GetCurrentUsername(r, st)
+	if (err != nil || username != creator) && !users.IsAdmin(r, st) {
+		w.Write([]byte("Insufficient permissions to edit series"))
+		return
+	}
+
+	title, description, ok := seriesForm(r)
+	if !ok {
+		w.Write([]byte(fmt.Sprintf("Series titles must be 1-%d characters", MAX_SERIES_TITLE_LENGTH)))
+		return
+	}
+
+	var taken bool
+	err = db.QueryRow("SELECT EXISTS(SELECT 1 FROM series WHERE title = ? AND id != ?)", title, seriesID).Scan(&taken)
+	if err == nil && taken {
+		w.Write([]byte("Series title already in use"))
+		return
+	}
+	if err == nil {
+		_, err = db.Exec("UPDATE series SET title = ?, description = ? WHERE id = ?", title, description, seriesID)
+	}
+	if err != nil {
+		log.Printf("failed to update series %v: %v", seriesID, err)
+		w.Write([]byte("Error updating series"))
+		return
+	}
+
+	w.Header().Set("HX-Refresh", "true")
+}
+
+func DeleteSeriesHandler(w http.ResponseWriter, r *http.Request, db *sql.DB, st *sessions.CookieStore) {
+	if !users.IsAdmin(r, st) {
+		log.Printf("non admin attempted to delete a series: %v", r.Host)
+		w.Write([]byte("Admins only"))
+		return
+	}
+
+	seriesID, err := strconv.ParseInt(r.FormValue("series_id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid series", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		w.Write([]byte("Database error"))
+		return
+	}
+	defer tx.Rollback()
+
+	// the pages stay, they just aren't in a series anymore
+	_, err = tx.Exec("DELETE FROM series_pages WHERE series_id = ?", seriesID)
+	if err == nil {
+		_, err = tx.Exec("DELETE FROM series WHERE id = ?", seriesID)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Printf("failed to delete series %v: %v", seriesID, err)
+		w.Write([]byte("Error deleting series"))
+		return
+	}
+
+	w.Header().Set("HX-Redirect", "/series")
+}
+
+// canEditSeriesPage reports whether the current user can move pageID in its series, the
+// same as editing it: its uploader or an admin
+func canEditSeriesPage(r *http.Request, db *sql.DB, st *sessions.CookieStore, pageID int64) (bool, error) {
+	var uploader string
+	err := db.QueryRow("SELECT uploader FROM pages WHERE id = ?", pageID).Scan(&uploader)
+	if err != nil {
+		return false, err
+	}
+	username, err := users.GetCurrentUsername(r, st)
+	return (err == nil && username == uploader) || users.IsAdmin(r, st), nil
+}
+
+// MoveSeriesPageHandler swaps a page with the one before ("up") or after ("down") it in
+// its series. drafts aren't listed so they are skipped over
+func MoveSeriesPageHandler(w http.ResponseWriter, r *http.Request, db *sql.DB, st *sessions.CookieStore) {
+	if !users.IsUploader(r, st) {
+		w.Write([]byte("Unauthorized access"))
+		return
+	}
+
+	pageID, err := strconv.ParseInt(r.FormValue("page_id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid page", http.StatusBadRequest)
+		return
+	}
+
+	allowed, err := canEditSeriesPage(r, db, st, pageID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Invalid page", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Printf("error getting uploader of page %v: %v", pageID, err)
+		w.Write([]byte("Database error"))
+		return
+	}
+	if !allowed {
+		w.Write([]byte("Insufficient permissions to edit page"))
+		return
+	}
+
+	var neighbour string
+	switch r.FormValue("direction") {
+	case "up":
+		neighbour = `sp.position < cur.position ORDER BY sp.position DESC`
+	case "down":
+		neighbour = `sp.position > cur.position ORDER BY sp.position ASC`
+	default:
+		http.Error(w, "Invalid direction", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		w.Write([]byte("Database error"))
+		return
+	}
+	defer tx.Rollback()
+
+	var position, other_page, other_position int64
+	err = tx.QueryRow(`
+		SELECT cur.position, sp.page_id, sp.position
+		FROM series_pages cur
+		JOIN series_pages sp ON sp.series_id = cur.series_id
+		JOIN pages p ON p.id = sp.page_id
+		WHERE cur.page_id = ? AND `+publishedFilter("p")+` AND `+neighbour+`
+		LIMIT 1`, pageID).Scan(&position, &other_page, &other_position)
+	if err == sql.ErrNoRows {
+		w.Write([]byte("Already at the end of the series"))
+		return
+	}
+	if err != nil {
+		log.Printf("error finding neighbour of page %v in its series: %v", pageID, err)
+		w.Write([]byte("Error moving page"))
+		return
+	}
+
+	_, err = tx.Exec("UPDATE series_pages SET position = ? WHERE page_id = ?", other_position, pageID)
+	if err == nil {
+		_, err = tx.Exec("UPDATE series_pages SET position = ? WHERE page_id = ?", position, other_page)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Printf("error moving page %v in its series: %v", pageID, err)
+		w.Write([]byte("Error moving page"))
+		return
+	}
+
+	w.Header().Set("HX-Refresh", "true")
+}
+
+func RemoveSeriesPageHandler(w http.ResponseWriter, r *http.Request, db *sql.DB, st *sessions.CookieStore) {
+	if !users.IsUploader(r, st) {
+		w.Write([]byte("Unauthorized access"))
+		return
+	}
+
+	pageID, err := strconv.ParseInt(r.FormValue("page_id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid page", http.StatusBadRequest)
+		return
+	}
+
+	allowed, err := canEditSeriesPage(r, db, st, pageID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Invalid page", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Printf("error getting uploader of page %v: %v", pageID, err)
+		w.Write([]byte("Database error"))
+		return
+	}
+	if !allowed {
+		w.Write([]byte("Insufficient permissions to edit page"))
+		return
+	}
+
+	_, err = db.Exec("DELETE FROM series_pages WHERE page_id = ?", pageID)
+	if err != nil {
+		log.Printf("error removing page %v from its series: %v", pageID, err)
+		w.Write([]byte("Error removing page"))
+		return
+	}
+
+	w.Header().Set("HX-Refresh", "true")
+}
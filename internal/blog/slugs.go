@@ -0,0 +1,242 @@
+package blog
+
+import (
+	// golang
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	// externals
+	"golang.org/x/text/unicode/norm"
+)
+
+// a page's title is its slug. pages are found by id, /p/{id}/{slug}, the slug is only there
+// to make the url readable. old /page/{title} links are looked up by slug, past titles are
+// kept in page_slugs for them. a slug belongs to one page, either as its title or in its history
+
+const (
+	MAX_SLUG_LENGTH = 80 // characters, longer titles are cut off
+	MAX_SLUG_SUFFIX = 1000
+)
+
+var (
+	errSlugTaken   = errors.New("slug already in use")
+	errInvalidSlug = errors.New("slugs can only have letters, numbers and single hyphens")
+)
+
+// letters with no decomposition to ascii, and the greek and cyrillic alphabets
+var transliterations = map[rune]string{
+	'ß': "ss", 'ẞ': "SS", 'æ': "ae", 'Æ': "AE", 'œ': "oe", 'Œ': "OE", 'ø': "o", 'Ø': "O",
+	'đ': "d", 'Đ': "D", 'ð': "d", 'Ð': "D", 'ł': "l", 'Ł': "L", 'þ': "th", 'Þ': "Th", 'ı': "i",
+
+	'α': "a", 'β': "v", 'γ': "g", 'δ': "d", 'ε': "e", 'ζ': "z", 'η': "i", 'θ': "th",
+	'ι': "i", 'κ': "k", 'λ': "l", 'μ': "m", 'ν': "n", 'ξ': "x", 'ο': "o", 'π': "p",
+	'ρ': "r", 'σ': "s", 'ς': "s", 'τ': "t", 'υ': "y", 'φ': "f", 'χ': "ch", 'ψ': "ps", 'ω': "o",
+
+	'а': "a", 'б': "b", 'в': "v", 'г': "g", 'д': "d", 'е': "e", 'ё': "yo", 'ж': "zh",
+	'з': "z", 'и': "i", 'й': "y", 'к': "k", 'л': "l", 'м': "m", 'н': "n", 'о': "o",
+	'п': "p", 'р': "r", 'с': "s", 'т': "t", 'у': "u", 'ф': "f", 'х': "kh", 'ц': "ts",
+	'ч': "ch", 'ш': "sh", 'щ': "shch", 'ъ': "", 'ы': "y", 'ь': "", 'э': "e", 'ю': "yu",
+	'я': "ya", 'і': "i", 'ї': "yi", 'є': "ye", 'ґ': "g",
+}
+
+// transliterate returns the latin spelling of char if it has one, in the case of char
+func transliterate(char rune) (string, bool) {
+	if latin, ok := transliterations[char]; ok {
+		return latin, true
+	}
+	latin, ok := transliterations[unicode.ToLower(char)]
+	if ok && latin != "" && unicode.IsUpper(char) {
+		latin = strings.ToUpper(latin[:1]) + latin[1:]
+	}
+	return latin, ok
+}
+
+// sanitizeTitle turns a display title into a slug: accents on latin letters are dropped,
+// greek and cyrillic are transliterated, other scripts (cjk, arabic, ...) are kept as they
+// are and anything but letters and numbers separates words with a hyphen. can be "" when
+// the title has no letters or numbers (only symbols/emoji)
+func sanitizeTitle(title string) string {
+	var result strings.Builder
+	hyphen := false
+	length := 0
+	latin := false // last letter was latin, its accents (combining marks) are dropped
+
+	// decomposed so accents are separate from their letters (é -> e + ´)
+	for _, char := range norm.NFKD.String(title) {
+		spelling, transliterated := transliterate(char)
+		switch {
+		case transliterated:
+			latin = true
+			if spelling == "" {
+				continue
+			}
+		case unicode.Is(unicode.Mn, char):
+			if latin {
+				continue
+			}
+			spelling = string(char)
+		case unicode.IsLetter(char) || unicode.IsNumber(char) || unicode.Is(unicode.Mc, char):
+			latin = unicode.Is(unicode.Latin, char)
+			spelling = string(char)
+		case char == '\'' || char == '’':
+			continue // apostrophes don't split words
+		default:
+			hyphen = true
+			continue
+		}
+
+		// cut off before the separator and letter that would go past the limit
+		add := utf8.RuneCountInString(spelling)
+		hyphen = hyphen && result.Len() > 0
+		if hyphen {
+			add++
+		}
+		if length+add > MAX_SLUG_LENGTH {
+			break
+		}
+
+		if hyphen {
+			result.WriteByte('-')
+		}
+		hyphen = false
+		result.WriteString(spelling)
+		length += add
+	}
+
+	return norm.NFC.String(result.String())
+}
+
+// validSlug reports whether a custom slug is one sanitizeTitle could have made
+func validSlug(slug string) bool {
+	if slug == "" || len([]rune(slug)) > MAX_SLUG_LENGTH {
+		return false
+	}
+	return sanitizeTitle(strings.ReplaceAll(slug, "-", " ")) == slug
+}
+
+func idSlug(pageID int64) string {
+	return fmt.Sprintf("page-%d", pageID)
+}
+
+// pageSlug picks the slug of a page: custom if given (errInvalidSlug/errSlugTaken if it can't
+// be used), otherwise made from the display title with a numeric suffix if it is taken. titles
+// without any letters get an id based slug, "" for a page not added yet (see idSlug)
+func pageSlug(tx *sql.Tx, custom string, display_title string, pageID int64) (string, error) {
+	if custom != "" {
+		if !validSlug(custom) {
+			return "", errInvalidSlug
+		}
+		taken, err := slugTaken(tx, custom, pageID)
+		if err != nil {
+			return "", err
+		}
+		if taken {
+			return "", errSlugTaken
+		}
+		return custom, nil
+	}
+
+	base := sanitizeTitle(display_title)
+	if base == "" {
+		if pageID == 0 {
+			return "", nil
+		}
+		base = idSlug(pageID)
+	}
+	return uniqueSlug(tx, base, pageID)
+}
+
+// uniqueSlug returns base, or base-2, base-3... whichever is free first. base is cut
+// short when needed so the suffixed slug stays within MAX_SLUG_LENGTH
+func uniqueSlug(tx *sql.Tx, base string, pageID int64) (string, error) {
+	for n := 1; n <= MAX_SLUG_SUFFIX; n++ {
+		slug := base
+		if n > 1 {
+			suffix := fmt.Sprintf("-%d", n)
+			slug = truncateSlug(base, MAX_SLUG_LENGTH-len(suffix)) + suffix
+		}
+		taken, err := slugTaken(tx, slug, pageID)
+		if err != nil {
+			return "", err
+		}
+		if !taken {
+			return slug, nil
+		}
+	}
+	return "", errSlugTaken
+}
+
+// truncateSlug cuts slug to at most length characters, without a trailing hyphen
+func truncateSlug(slug string, length int) string {
+	runes := []rune(slug)
+	if len(runes) <= length {
+		return slug
+	}
+	return strings.TrimRight(string(runes[:length]), "-")
+}
+
+// slugTaken reports whether slug is the title or a past title of a page other than pageID
+func slugTaken(tx *sql.Tx, slug string, pageID int64) (bool, error) {
+	var taken bool
+	err := tx.QueryRow(`
+		SELECT EXISTS(SELECT 1 FROM pages WHERE title = ?1 AND id != ?2)
+			OR EXISTS(SELECT 1 FROM page_slugs WHERE slug = ?1 AND page_id != ?2)`, slug, pageID).Scan(&taken)
+	if err != nil {
+		return false, fmt.Errorf("failed to check if slug is taken: %w", err)
+	}
+	return taken, nil
+}
+
+// renameSlug records a page's title change, old_title starts redirecting and new_title
+// leaves the history if the page is getting it back
+func renameSlug(tx *sql.Tx, pageID int64, old_title string, new_title string) error {
+	if old_title == new_title {
+		return nil
+	}
+
+	_, err := tx.Exec("DELETE FROM page_slugs WHERE slug = ? AND page_id = ?", new_title, pageID)
+	if err != nil {
+		return fmt.Errorf("failed to remove slug from history: %w", err)
+	}
+
+	_, err = tx.Exec("INSERT OR IGNORE INTO page_slugs (slug, page_id) VALUES (?, ?)", old_title, pageID)
+	if err != nil {
+		return fmt.Errorf("failed to add slug to history: %w", err)
+	}
+	return nil
+}
+
+// pageBySlug returns the id and current title of the page with slug as its title or one of
+// its past titles
+func pageBySlug(db *sql.DB, slug string) (int64, string, error) {
+	var pageID int64
+	var title string
+	err := db.QueryRow(`
+		SELECT id, title FROM pages WHERE title = ?1
+		UNION ALL
+		SELECT p.id, p.title FROM page_slugs s JOIN pages p ON p.id = s.page_id WHERE s.slug = ?1
+		LIMIT 1`, slug).Scan(&pageID, &title)
+	return pageID, title, err
+}
+
+// pageURL is the canonical url of a page
+func pageURL(pageID int64, title string) string {
+	return fmt.Sprintf("/p/%d/%s", pageID, url.PathEscape(title))
+}
+
+// URL is the canonical url of the page
+func (p BlogPage) URL() string {
+	return pageURL(p.ID, p.Title)
+}
+
+// pathID reads the page id from a prefix{id}[/...] path
+func pathID(path string, prefix string) (int64, error) {
+	id, _, _ := strings.Cut(strings.TrimPrefix(path, prefix), "/")
+	return strconv.ParseInt(id, 10, 64)
+}
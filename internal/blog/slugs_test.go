@@ -0,0 +1,167 @@
+package blog
+
+import (
+	// golang
+	"database/sql"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	// externals
+	_ "github.com/glebarez/sqlite"
+)
+
+// testDB opens an in-memory database with the given tables, closed with the test
+func testDB(t *testing.T, schema string) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1) // every connection to :memory: is its own database
+	t.Cleanup(func() { db.Close() })
+
+	_, err = db.Exec(schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestSanitizeTitle(t *testing.T) {
+	tests := []struct {
+		title string
+		want  string
+	}{
+		{"Hello World", "Hello-World"},
+		{"  Hello,   World!  ", "Hello-World"},
+		{"Don't Stop", "Dont-Stop"},
+		{"Don’t Stop", "Dont-Stop"},
+		{"C++ & Go", "C-Go"},
+		{"Crème Brûlée", "Creme-Brulee"},
+		{"Straße", "Strasse"},
+		{"Ærøskøbing", "AEroskobing"},
+		{"Ελληνικά", "Ellinika"},
+		{"Москва", "Moskva"},
+		{"Съезд", "Sezd"},
+		{"日本語のタイトル", "日本語のタイトル"},
+		{"東京 2024", "東京-2024"},
+		{"हिन्दी", "हिन्दी"},
+		{"ﬁne", "fine"},
+		{"🎮🎮🎮", ""},
+		{"!!!", ""},
+		{"", ""},
+	}
+
+	for _, tt := range tests {
+		if got := sanitizeTitle(tt.title); got != tt.want {
+			t.Errorf("sanitizeTitle(%q) = %q, want %q", tt.title, got, tt.want)
+		}
+	}
+}
+
+func TestSanitizeTitleLength(t *testing.T) {
+	tests := []string{
+		strings.Repeat("a", MAX_SLUG_LENGTH+20),
+		strings.Repeat("日", MAX_SLUG_LENGTH+20),
+		strings.Repeat("word ", MAX_SLUG_LENGTH),
+		strings.Repeat("é", MAX_SLUG_LENGTH+20),
+	}
+
+	for _, title := range tests {
+		got := sanitizeTitle(title)
+		if n := utf8.RuneCountInString(got); n > MAX_SLUG_LENGTH {
+			t.Errorf("sanitizeTitle(%.10q...) is %v characters, want at most %v", title, n, MAX_SLUG_LENGTH)
+		}
+		if strings.HasSuffix(got, "-") {
+			t.Errorf("sanitizeTitle(%.10q...) = %q ends with a hyphen", title, got)
+		}
+	}
+}
+
+func TestValidSlug(t *testing.T) {
+	tests := []struct {
+		slug string
+		want bool
+	}{
+		{"hello-world", true},
+		{"日本語", true},
+		{"page-2", true},
+		{"", false},
+		{"-hello", false},
+		{"hello-", false},
+		{"hello--world", false},
+		{"hello world", false},
+		{"héllo", false},
+		{"c++", false},
+		{strings.Repeat("a", MAX_SLUG_LENGTH), true},
+		{strings.Repeat("a", MAX_SLUG_LENGTH+1), false},
+	}
+
+	for _, tt := range tests {
+		if got := validSlug(tt.slug); got != tt.want {
+			t.Errorf("validSlug(%q) = %v, want %v", tt.slug, got, tt.want)
+		}
+	}
+}
+
+func TestUniqueSlug(t *testing.T) {
+	// titles sanitizeTitle cut to the limit, the suffix has to fit in it too
+	long := strings.Repeat("a", MAX_SLUG_LENGTH)
+	hyphenated := strings.Repeat("a", MAX_SLUG_LENGTH-3) + "-bc"
+	db := testDB(t, `
+		CREATE TABLE pages (id INTEGER PRIMARY KEY, title TEXT NOT NULL);
+		CREATE TABLE page_slugs (slug TEXT PRIMARY KEY, page_id INTEGER NOT NULL);
+		INSERT INTO pages (id, title) VALUES (1, 'taken'), (2, 'taken-2'), (3, 'mine'),
+			(4, '`+long+`'), (5, '`+hyphenated+`');
+		INSERT INTO page_slugs (slug, page_id) VALUES ('renamed', 1), ('old-mine', 3);`)
+
+	tests := []struct {
+		base   string
+		pageID int64
+		want   string
+	}{
+		{"free", 0, "free"},
+		{"taken", 0, "taken-3"},     // taken and taken-2 are titles
+		{"renamed", 0, "renamed-2"}, // past titles still redirect
+		{"mine", 3, "mine"},         // a page keeps its own title
+		{"old-mine", 3, "old-mine"}, // and can take back a past one
+		{"taken", 2, "taken-2"},
+		{long, 0, long[:MAX_SLUG_LENGTH-2] + "-2"},
+		{long, 4, long},
+		{hyphenated, 0, hyphenated[:MAX_SLUG_LENGTH-3] + "-2"}, // no double hyphen where it's cut
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	for _, tt := range tests {
+		got, err := uniqueSlug(tx, tt.base, tt.pageID)
+		if err != nil {
+			t.Errorf("uniqueSlug(%q, %v): %v", tt.base, tt.pageID, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("uniqueSlug(%q, %v) = %q, want %q", tt.base, tt.pageID, got, tt.want)
+		}
+		if !validSlug(got) {
+			t.Errorf("uniqueSlug(%q, %v) = %q is not a valid slug", tt.base, tt.pageID, got)
+		}
+	}
+
+	custom, err := pageSlug(tx, "taken", "Anything", 0)
+	if err != errSlugTaken {
+		t.Errorf("pageSlug with a taken custom slug = %q, %v, want errSlugTaken", custom, err)
+	}
+	custom, err = pageSlug(tx, "Not Valid", "Anything", 0)
+	if err != errInvalidSlug {
+		t.Errorf("pageSlug with an invalid custom slug = %q, %v, want errInvalidSlug", custom, err)
+	}
+	slug, err := pageSlug(tx, "", "🎮", 7)
+	if err != nil || slug != "page-7" {
+		t.Errorf("pageSlug of a title without letters = %q, %v, want page-7", slug, err)
+	}
+}
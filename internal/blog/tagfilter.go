@@ -0,0 +1,153 @@
+package blog
+
+import (
+	// golang
+	"database/sql"
+	"errors"
+	"html/template"
+	"log"
+	"net/url"
+	"strings"
+)
+
+// a tag filter is the ?tag= parameters of the home page (and the prev/next links of a
+// page opened from it): pages need every tag, or any of them with match=any, and none of
+// the tags written with a leading '-' (?tag=gamedev&tag=-meta). like a single tag, a tag
+// matches the pages of the tags under it too
+
+const MAX_FILTER_TAGS = 10
+
+// TagFilter is the tags a listing is filtered by
+type TagFilter struct {
+	Include []string
+	Exclude []string
+	Any     bool // pages need one of Include instead of all of them
+}
+
+// parseTagFilter reads the tag filter of a url's query, aliases are replaced by their tag
+// like on /tag/{name}. repeats and tags past MAX_FILTER_TAGS are ignored
+func parseTagFilter(db *sql.DB, query url.Values) TagFilter {
+	var f TagFilter
+	seen := map[string]bool{}
+	for _, value := range query["tag"] {
+		name, exclude := strings.CutPrefix(strings.TrimSpace(value), "-")
+		name = filterTag(db, name)
+		if name == "" || seen[name] || len(seen) >= MAX_FILTER_TAGS {
+			continue
+		}
+		seen[name] = true
+		if exclude {
+			f.Exclude = append(f.Exclude, name)
+		} else {
+			f.Include = append(f.Include, name)
+		}
+	}
+	f.Any = query.Get("match") == "any" && len(f.Include) > 1
+	return f
+}
+
+// filterTag is the stored name of a tag in a filter. a name that isn't a tag (or can't be one)
+// is only case folded, it matches no pages
+func filterTag(db *sql.DB, name string) string {
+	tag, err := canonicalTag(db, name)
+	if err != nil {
+		var tag_err tagError
+		if err != sql.ErrNoRows && !errors.As(err, &tag_err) {
+			log.Printf("error resolving filter tag '%v': %v", name, err)
+		}
+		return foldTag(name)
+	}
+	return tag
+}
+
+// Empty reports whether the filter has no tags
+func (f TagFilter) Empty() bool {
+	return len(f.Include) == 0 && len(f.Exclude) == 0
+}
+
+// Single is the tag when the filter is just one tag, "" otherwise
+func (f TagFilter) Single() string {
+	if len(f.Include) == 1 && len(f.Exclude) == 0 {
+		return f.Include[0]
+	}
+	return ""
+}
+
+// where is the WHERE condition for pages matching the filter with its parameters, alias
+// is the pages table alias
+func (f TagFilter) where(alias string) (string, []interface{}) {
+	conditions := []string{}
+	args := []interface{}{}
+
+	if len(f.Include) > 0 {
+		include := []string{}
+		for _, name := range f.Include {
+			include = append(include, taggedFilter(alias))
+			args = append(args, name)
+		}
+		join := " AND "
+		if f.Any {
+			join = " OR "
+		}
+		conditions = append(conditions, "("+strings.Join(include, join)+")")
+	}
+	for _, name := range f.Exclude {
+		conditions = append(conditions, "NOT "+taggedFilter(alias))
+		args = append(args, name)
+	}
+
+	if len(conditions) == 0 {
+		return "1", args
+	}
+	return strings.Join(conditions, " AND "), args
+}
+
+// Values is the filter as ?tag= values, excluded tags with their '-'
+func (f TagFilter) Values() []string {
+	values := append([]string{}, f.Include...)
+	for _, name := range f.Exclude {
+		values = append(values, "-"+name)
+	}
+	return values
+}
+
+// Query is the filter as a url query ("?tag=..."), "" for no filter
+func (f TagFilter) Query() template.URL {
+	if f.Empty() {
+		return ""
+	}
+	query := url.Values{"tag": f.Values()}
+	if f.Any {
+		query.Set("match", "any")
+	}
+	return template.URL("?" + query.Encode())
+}
+
+// Without is the home page url of the filter without a tag, value is as in Values
+func (f TagFilter) Without(value string) template.URL {
+	return "/" + f.remove(value).Query()
+}
+
+// ToggleMatch is the home page url of the filter matching any tag instead of all of them
+// or the other way around
+func (f TagFilter) ToggleMatch() template.URL {
+	f.Any = !f.Any
+	return "/" + f.Query()
+}
+
+func (f TagFilter) remove(value string) TagFilter {
+	name, exclude := strings.CutPrefix(value, "-")
+	var removed TagFilter
+	for _, tag := range f.Include {
+		if exclude || tag != name {
+			removed.Include = append(removed.Include, tag)
+		}
+	}
+	for _, tag := range f.Exclude {
+		if !exclude || tag != name {
+			removed.Exclude = append(removed.Exclude, tag)
+		}
+	}
+	removed.Any = f.Any && len(removed.Include) > 1
+	return removed
+}
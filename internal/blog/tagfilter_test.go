@@ -0,0 +1,143 @@
+package blog
+
+import (
+	// golang
+	"fmt"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+// pages 1-4 tagged so that filters can be told apart, gamedev is under programming
+// and game-dev is an alias of gamedev
+const tagFilterSchema = `
+	CREATE TABLE pages (id INTEGER PRIMARY KEY);
+	CREATE TABLE tags (id INTEGER PRIMARY KEY, name TEXT UNIQUE NOT NULL, parent_id INTEGER);
+	CREATE TABLE tag_aliases (alias TEXT PRIMARY KEY, tag_id INTEGER NOT NULL);
+	CREATE TABLE page_tags (page_id INTEGER, tag_id INTEGER);
+
+	INSERT INTO pages (id) VALUES (1), (2), (3), (4);
+	INSERT INTO tags (id, name, parent_id) VALUES (1, 'programming', NULL), (2, 'gamedev', 1), (3, 'art', NULL), (4, 'meta', NULL), (5, '日本語', NULL);
+	INSERT INTO tag_aliases (alias, tag_id) VALUES ('game-dev', 2), ('coding', 1);
+	INSERT INTO page_tags (page_id, tag_id) VALUES
+		(1, 2), (1, 3),
+		(2, 1),
+		(3, 3), (3, 4),
+		(4, 2), (4, 4), (4, 5);`
+
+func TestParseTagFilter(t *testing.T) {
+	db := testDB(t, tagFilterSchema)
+
+	many := url.Values{}
+	for i := 0; i < MAX_FILTER_TAGS+3; i++ {
+		many.Add("tag", fmt.Sprintf("tag%v", i))
+	}
+	limited := TagFilter{}
+	for i := 0; i < MAX_FILTER_TAGS; i++ {
+		limited.Include = append(limited.Include, fmt.Sprintf("tag%v", i))
+	}
+
+	tests := []struct {
+		name  string
+		query url.Values
+		want  TagFilter
+	}{
+		{"none", url.Values{}, TagFilter{}},
+		{"one tag", url.Values{"tag": {"gamedev"}}, TagFilter{Include: []string{"gamedev"}}},
+		{"case folded", url.Values{"tag": {"GameDev"}}, TagFilter{Include: []string{"gamedev"}}},
+		{"full width", url.Values{"tag": {"ＧａｍｅＤｅｖ"}}, TagFilter{Include: []string{"gamedev"}}},
+		{"alias", url.Values{"tag": {"game-dev"}}, TagFilter{Include: []string{"gamedev"}}},
+		{"excluded alias", url.Values{"tag": {"art", "-coding"}}, TagFilter{Include: []string{"art"}, Exclude: []string{"programming"}}},
+		{"alias repeats its tag", url.Values{"tag": {"gamedev", "game-dev", "GAMEDEV"}}, TagFilter{Include: []string{"gamedev"}}},
+		{"unicode", url.Values{"tag": {"日本語"}}, TagFilter{Include: []string{"日本語"}}},
+		{"unknown tag kept", url.Values{"tag": {"nothing"}}, TagFilter{Include: []string{"nothing"}}},
+		{"invalid tag kept", url.Values{"tag": {"c++"}}, TagFilter{Include: []string{"c++"}}},
+		{"empty values", url.Values{"tag": {"", " ", "-"}}, TagFilter{}},
+		{"trimmed", url.Values{"tag": {" art ", " -meta"}}, TagFilter{Include: []string{"art"}, Exclude: []string{"meta"}}},
+		{"included then excluded", url.Values{"tag": {"art", "-art"}}, TagFilter{Include: []string{"art"}}},
+		{"match any", url.Values{"tag": {"art", "meta"}, "match": {"any"}}, TagFilter{Include: []string{"art", "meta"}, Any: true}},
+		{"match any needs two tags", url.Values{"tag": {"art", "-meta"}, "match": {"any"}}, TagFilter{Include: []string{"art"}, Exclude: []string{"meta"}}},
+		{"limited", many, limited},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := parseTagFilter(db, tt.query)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseTagFilter(%v) = %+v, want %+v", tt.query, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTagFilterWhere(t *testing.T) {
+	db := testDB(t, tagFilterSchema)
+
+	tests := []struct {
+		filter TagFilter
+		want   []int64
+	}{
+		{TagFilter{}, []int64{1, 2, 3, 4}},
+		{TagFilter{Include: []string{"art"}}, []int64{1, 3}},
+		{TagFilter{Include: []string{"programming"}}, []int64{1, 2, 4}}, // and its subtag gamedev
+		{TagFilter{Include: []string{"gamedev", "art"}}, []int64{1}},
+		{TagFilter{Include: []string{"gamedev", "art"}, Any: true}, []int64{1, 3, 4}},
+		{TagFilter{Exclude: []string{"meta"}}, []int64{1, 2}},
+		{TagFilter{Exclude: []string{"programming"}}, []int64{3}},
+		{TagFilter{Include: []string{"gamedev"}, Exclude: []string{"meta"}}, []int64{1}},
+		{TagFilter{Include: []string{"art", "日本語"}, Exclude: []string{"gamedev"}, Any: true}, []int64{3}},
+		{TagFilter{Include: []string{"art"}, Exclude: []string{"art"}}, nil},
+		{TagFilter{Include: []string{"nothing"}}, nil},
+		{TagFilter{Exclude: []string{"nothing"}}, []int64{1, 2, 3, 4}},
+	}
+
+	for _, tt := range tests {
+		where, args := tt.filter.where("p")
+		rows, err := db.Query("SELECT p.id FROM pages p WHERE "+where+" ORDER BY p.id", args...)
+		if err != nil {
+			t.Fatalf("where of %+v: %v", tt.filter, err)
+		}
+		var got []int64
+		for rows.Next() {
+			var id int64
+			if err := rows.Scan(&id); err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, id)
+		}
+		rows.Close()
+
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("pages matching %+v = %v, want %v", tt.filter, got, tt.want)
+		}
+	}
+}
+
+func TestTagFilterRemove(t *testing.T) {
+	filter := TagFilter{Include: []string{"gamedev", "art"}, Exclude: []string{"meta", "art"}, Any: true}
+
+	tests := []struct {
+		value string
+		want  TagFilter
+	}{
+		{"gamedev", TagFilter{Include: []string{"art"}, Exclude: []string{"meta", "art"}}},
+		{"art", TagFilter{Include: []string{"gamedev"}, Exclude: []string{"meta", "art"}}},
+		{"-art", TagFilter{Include: []string{"gamedev", "art"}, Exclude: []string{"meta"}, Any: true}},
+		{"-meta", TagFilter{Include: []string{"gamedev", "art"}, Exclude: []string{"art"}, Any: true}},
+		{"nothing", filter},
+		{"-gamedev", filter},
+	}
+
+	for _, tt := range tests {
+		if got := filter.remove(tt.value); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("remove(%q) = %+v, want %+v", tt.value, got, tt.want)
+		}
+	}
+
+	if got := filter.Without("gamedev"); got != "/?tag=art&tag=-meta&tag=-art" {
+		t.Errorf("Without(gamedev) = %q, want /?tag=art&tag=-meta&tag=-art", got)
+	}
+	if got := (TagFilter{Include: []string{"art"}}).Without("art"); got != "/" {
+		t.Errorf("Without of the last tag = %q, want /", got)
+	}
+}
@@ -0,0 +1,1056 @@
+package blog
+
+import (
+	// internal
+	"blog/internal/users"
+
+	// golang
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	// externals
+	"github.com/gorilla/sessions"
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+)
+
+// tags are made when a page first uses them and removed when no page does, unless an
+// admin gave them a description or aliases. an alias is another name for a tag, typing
+// it on the upload/edit form tags the page with the tag it points to. tags and aliases
+// are stored normalized (see normalizeTag), so "GameDev" and "gamedev" are one tag.
+// tags can have a parent tag ("gamedev" > "shaders"), filtering by a tag includes the
+// pages of the tags under it
+
+const (
+	MAX_TAG_LENGTH   = 32 // characters, long tags don't fit the tag list on mobile
+	MAX_PAGE_TAGS    = 15
+	MAX_TAG_DEPTH    = 32 // guards the walks up the tree
+	MAX_RELATED_TAGS = 10
+)
+
+// subtagsQuery selects the ids of the tag named by its parameter and every tag under it
+var subtagsQuery = subtagsOf("SELECT id FROM tags WHERE name = ?")
+
+// subtagsOf selects the ids of the tags seed selects and every tag under them
+func subtagsOf(seed string) string {
+	return `
+	WITH RECURSIVE subtags(id) AS (
+		` + seed + `
+		UNION
+		SELECT sub.id FROM tags sub JOIN subtags s ON sub.parent_id = s.id
+	)
+	SELECT id FROM subtags`
+}
+
+// taggedFilter is the WHERE condition for pages tagged with a tag (its name is the
+// parameter) or any tag under it, alias is the pages table alias
+func taggedFilter(alias string) string {
+	return subtagFilter(alias, "SELECT id FROM tags WHERE name = ?")
+}
+
+// subtagFilter is taggedFilter for the tags seed selects
+func subtagFilter(alias string, seed string) string {
+	return "EXISTS (SELECT 1 FROM page_tags tagged WHERE tagged.page_id = " + column(alias, "id") +
+		" AND tagged.tag_id IN (" + subtagsOf(seed) + "))"
+}
+
+// tagPageCount selects the number of pages the current user can see tagged with the tag
+// t (or a tag under it), t is the tags table alias of the outer query
+func tagPageCount(show_hidden bool) string {
+	return "(SELECT COUNT(*) FROM pages counted WHERE " + subtagFilter("counted", "SELECT t.id") +
+		" AND " + visibleFilter("counted", show_hidden) + ")"
+}
+
+// tagURL is the url of a tag's landing page
+func tagURL(name string) string {
+	return "/tag/" + url.PathEscape(name)
+}
+
+// URL is the url of the tag's landing page
+func (t Tag) URL() string {
+	return tagURL(t.Name)
+}
+
+var (
+	errTagTaken    = errors.New("name already used by a tag or alias")
+	errTooManyTags = fmt.Errorf("pages can have at most %d tags", MAX_PAGE_TAGS)
+)
+
+// tagError is a tag that can't be used and why, shown on the upload/edit form
+type tagError struct {
+	tag    string
+	reason string
+}
+
+func (e tagError) Error() string {
+	return fmt.Sprintf("tag '%s' %s", e.tag, e.reason)
+}
+
+// foldTag folds case and compatibility characters (full width letters, ligatures...)
+func foldTag(name string) string {
+	return norm.NFC.String(cases.Fold().String(norm.NFKC.String(name)))
+}
+
+// tagRune reports whether char is allowed in tags: letters, numbers, '-' and '_'
+// (and the marks some scripts need with their letters)
+func tagRune(char rune) bool {
+	return unicode.IsLetter(char) || unicode.IsNumber(char) || unicode.IsMark(char) || char == '-' || char == '_'
+}
+
+// normalizeTag returns the stored form of a tag typed on a form, or a tagError
+func normalizeTag(name string) (string, error) {
+	tag := foldTag(name)
+
+	word := false
+	for _, char := range tag {
+		if !tagRune(char) {
+			return "", tagError{name, "can only have letters, numbers, '-' and '_'"}
+		}
+		word = word || unicode.IsLetter(char) || unicode.IsNumber(char)
+	}
+	if !word {
+		return "", tagError{name, "needs a letter or number"}
+	}
+	// a leading '-' excludes a tag when filtering (see TagFilter)
+	if strings.HasPrefix(tag, "-") {
+		return "", tagError{name, "can't start with '-'"}
+	}
+	if utf8.RuneCountInString(tag) > MAX_TAG_LENGTH {
+		return "", tagError{name, fmt.Sprintf("is longer than %d characters", MAX_TAG_LENGTH)}
+	}
+	return tag, nil
+}
+
+// parseTags splits the tags field of the upload/edit form, tags are separated by spaces
+// or commas, into normalized tags without repeats
+func parseTags(field string) ([]string, error) {
+	tags := []string{}
+	seen := map[string]bool{}
+	for _, name := range strings.Fields(strings.ReplaceAll(field, ",", " ")) {
+		tag, err := normalizeTag(name)
+		if err != nil {
+			return nil, err
+		}
+		if seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		tags = append(tags, tag)
+	}
+
+	if len(tags) > MAX_PAGE_TAGS {
+		return nil, errTooManyTags
+	}
+	return tags, nil
+}
+
+// cleanTag is normalizeTag for tags saved before tags were normalized: characters that
+// aren't allowed become hyphens and long tags are cut. "" if nothing is left
+func cleanTag(name string) string {
+	var result strings.Builder
+	length := 0
+	hyphen := false
+	for _, char := range foldTag(name) {
+		if !tagRune(char) {
+			hyphen = true
+			continue
+		}
+		if hyphen && length > 0 {
+			if length+1 >= MAX_TAG_LENGTH {
+				break
+			}
+			result.WriteByte('-')
+			length++
+		}
+		if length >= MAX_TAG_LENGTH {
+			break
+		}
+		hyphen = false
+		result.WriteRune(char)
+		length++
+	}
+
+	tag := strings.Trim(result.String(), "-_")
+	if strings.IndexFunc(tag, func(c rune) bool { return unicode.IsLetter(c) || unicode.IsNumber(c) }) == -1 {
+		return ""
+	}
+	return tag
+}
+
+// resolveTag returns the tag name is an alias of, or name itself
+func resolveTag(tx *sql.Tx, name string) (string, error) {
+	var tag string
+	err := tx.QueryRow(`
+		SELECT t.name FROM tag_aliases a JOIN tags t ON t.id = a.tag_id
+		WHERE a.alias = ?`, name).Scan(&tag)
+	if err == sql.ErrNoRows {
+		return name, nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve tag '%s': %w", name, err)
+	}
+	return tag, nil
+}
+
+// tagNameTaken reports whether name is the name of a tag other than tagID, or an alias
+func tagNameTaken(tx *sql.Tx, name string, tagID int64) (bool, error) {
+	var taken bool
+	err := tx.QueryRow(`
+		SELECT EXISTS(SELECT 1 FROM tags WHERE name = ?1 AND id != ?2)
+			OR EXISTS(SELECT 1 FROM tag_aliases WHERE alias = ?1)`, name, tagID).Scan(&taken)
+	return taken, err
+}
+
+// cleanUpTags removes tags no page uses anymore, tags an admin described, gave aliases
+// or put other tags under are kept
+func cleanUpTags(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+        DELETE FROM tags
+        WHERE NOT EXISTS (SELECT 1 FROM page_tags WHERE page_tags.tag_id = tags.id)
+			AND description = ''
+			AND NOT EXISTS (SELECT 1 FROM tag_aliases WHERE tag_aliases.tag_id = tags.id)
+			AND NOT EXISTS (SELECT 1 FROM tags sub WHERE sub.parent_id = tags.id)
+    `)
+	return err
+}
+
+// tagTree returns the tags used by pages the current user can see as a tree, sorted by
+// name, with the selected ones marked and their page counts. parents of those tags are
+// included even when no visible page uses them
+func tagTree(db *sql.DB, show_hidden bool, selected []string) ([]Tag, error) {
+	rows, err := db.Query(`
+		SELECT t.id, t.name, t.description, IFNULL(t.parent_id, 0),
+			EXISTS (
+				SELECT 1 FROM page_tags pt JOIN pages p ON p.id = pt.page_id
+				WHERE pt.tag_id = t.id AND ` + visibleFilter("p", show_hidden) + `),
+			` + tagPageCount(show_hidden) + `
+		FROM tags t
+		ORDER BY t.name`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get tags: %w", err)
+	}
+	defer rows.Close()
+
+	var all []Tag
+	var visible []bool
+	byID := map[int64]int{}
+	for rows.Next() {
+		var t Tag
+		var v bool
+		if err := rows.Scan(&t.ID, &t.Name, &t.Description, &t.ParentID, &v, &t.PageCount); err != nil {
+			return nil, fmt.Errorf("failed to scan tag: %w", err)
+		}
+		t.Selected = slices.Contains(selected, t.Name)
+		byID[t.ID] = len(all)
+		all = append(all, t)
+		visible = append(visible, v)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// a visible tag shows the tags above it too
+	used := map[int64]bool{}
+	for i, t := range all {
+		if !visible[i] {
+			continue
+		}
+		for depth := 0; !used[t.ID] && depth < MAX_TAG_DEPTH; depth++ {
+			used[t.ID] = true
+			parent, ok := byID[t.ParentID]
+			if !ok {
+				break
+			}
+			t = all[parent]
+		}
+	}
+
+	children := map[int64][]int{}
+	for i, t := range all {
+		if !used[t.ID] {
+			continue
+		}
+		parent := t.ParentID
+		if !used[parent] {
+			parent = 0
+		}
+		children[parent] = append(children[parent], i)
+	}
+
+	var build func(parent int64, depth int) []Tag
+	build = func(parent int64, depth int) []Tag {
+		var tags []Tag
+		for _, i := range children[parent] {
+			t := all[i]
+			if depth < MAX_TAG_DEPTH {
+				t.Children = build(t.ID, depth+1)
+			}
+			tags = append(tags, t)
+		}
+		return tags
+	}
+	return build(0, 0), nil
+}
+
+// tagPath returns a tag and the tags above it, the top level tag first
+func tagPath(db *sql.DB, name string) ([]Tag, error) {
+	rows, err := db.Query(`
+		WITH RECURSIVE path(id, name, description, parent_id, depth) AS (
+			SELECT id, name, description, parent_id, 0 FROM tags WHERE name = ?
+			UNION ALL
+			SELECT t.id, t.name, t.description, t.parent_id, path.depth + 1
+			FROM tags t JOIN path ON t.id = path.parent_id
+			WHERE path.depth < ?
+		)
+		SELECT id, name, description FROM path ORDER BY depth DESC`, name, MAX_TAG_DEPTH)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get path of tag '%s': %w", name, err)
+	}
+	defer rows.Close()
+
+	var path []Tag
+	for rows.Next() {
+		var t Tag
+		if err := rows.Scan(&t.ID, &t.Name, &t.Description); err != nil {
+			return nil, fmt.Errorf("failed to scan tag: %w", err)
+		}
+		path = append(path, t)
+	}
+	return path, rows.Err()
+}
+
+// canonicalTag returns the stored name of a tag typed in a url, following aliases
+func canonicalTag(db *sql.DB, name string) (string, error) {
+	tag, err := normalizeTag(name)
+	if err != nil {
+		return "", err
+	}
+	err = db.QueryRow(`
+		SELECT name FROM tags WHERE name = ?1
+		UNION ALL
+		SELECT t.name FROM tag_aliases a JOIN tags t ON t.id = a.tag_id WHERE a.alias = ?1
+		LIMIT 1`, tag).Scan(&tag)
+	return tag, err
+}
+
+// getTagPages returns the pages the current user can see tagged with name or a tag under
+// it, newest first
+func getTagPages(db *sql.DB, name string, show_hidden bool) ([]BlogPage, error) {
+	rows, err := db.Query(`
+		SELECT p.id, p.title, p.display_title, p.post_time, p.thumbnail, p.uploader, p.animated, IFNULL(p.unlisted, 0), p.level
+		FROM pages p
+		WHERE `+taggedFilter("p")+` AND `+visibleFilter("p", show_hidden)+`
+		ORDER BY p.post_time DESC`, name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get pages with tag '%s': %w", name, err)
+	}
+	defer rows.Close()
+
+	pages := []BlogPage{}
+	for rows.Next() {
+		var p BlogPage
+		err := rows.Scan(&p.ID, &p.Title, &p.DisplayTitle, &p.PostTime, &p.Thumbnail, &p.Uploader, &p.Animated, &p.Unlisted, &p.Level)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan page with tag '%s': %w", name, err)
+		}
+		pages = append(pages, p)
+	}
+	return pages, rows.Err()
+}
+
+// getSubtags returns the tags right under a tag that the current user can see pages of
+func getSubtags(db *sql.DB, tagID int64, show_hidden bool) ([]Tag, error) {
+	rows, err := db.Query(`
+		SELECT id, name, description, count FROM (
+			SELECT t.id, t.name, t.description, `+tagPageCount(show_hidden)+` AS count
+			FROM tags t
+			WHERE t.parent_id = ?
+		)
+		WHERE count > 0
+		ORDER BY name`, tagID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get subtags of %v: %w", tagID, err)
+	}
+	defer rows.Close()
+
+	tags := []Tag{}
+	for rows.Next() {
+		var t Tag
+		if err := rows.Scan(&t.ID, &t.Name, &t.Description, &t.PageCount); err != nil {
+			return nil, fmt.Errorf("failed to scan subtag: %w", err)
+		}
+		tags = append(tags, t)
+	}
+	return tags, rows.Err()
+}
+
+// getRelatedTags returns the tags most used together with a tag (or the tags under it),
+// PageCount is the number of pages they share. the tag's own subtags aren't included
+func getRelatedTags(db *sql.DB, name string, show_hidden bool) ([]Tag, error) {
+	rows, err := db.Query(`
+		SELECT t.id, t.name, t.description, COUNT(*) AS shared
+		FROM page_tags pt
+		JOIN tags t ON t.id = pt.tag_id
+		JOIN pages p ON p.id = pt.page_id
+		WHERE `+taggedFilter("p")+` AND `+visibleFilter("p", show_hidden)+`
+			AND t.id NOT IN (`+subtagsQuery+`)
+		GROUP BY t.id
+		ORDER BY shared DESC, t.name
+		LIMIT ?`, name, name, MAX_RELATED_TAGS)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get tags related to '%s': %w", name, err)
+	}
+	defer rows.Close()
+
+	tags := []Tag{}
+	for rows.Next() {
+		var t Tag
+		if err := rows.Scan(&t.ID, &t.Name, &t.Description, &t.PageCount); err != nil {
+			return nil, fmt.Errorf("failed to scan related tag: %w", err)
+		}
+		tags = append(tags, t)
+	}
+	return tags, rows.Err()
+}
+
+// getTagAliases returns the aliases of a tag
+func getTagAliases(db *sql.DB, tagID int64) ([]string, error) {
+	rows, err := db.Query("SELECT alias FROM tag_aliases WHERE tag_id = ? ORDER BY alias", tagID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get aliases of tag %v: %w", tagID, err)
+	}
+	defer rows.Close()
+
+	aliases := []string{}
+	for rows.Next() {
+		var alias string
+		if err := rows.Scan(&alias); err != nil {
+			return nil, fmt.Errorf("failed to scan tag alias: %w", err)
+		}
+		aliases = append(aliases, alias)
+	}
+	return aliases, rows.Err()
+}
+
+//
+// Tag pages
+//
+
+// TagSummary is what a tag's landing page shows, PageCount counts the pages of the tags
+// under it too
+type TagSummary struct {
+	Tag
+	Path      []Tag // the tags above it, top level first
+	Subtags   []Tag
+	Related   []Tag
+	Pages     []BlogPage
+	FirstPost time.Time
+	LastPost  time.Time
+}
+
+func TagIndexPage(w http.ResponseWriter, r *http.Request, db *sql.DB, st *sessions.CookieStore) {
+	if !users.IsAuthed(r, st) {
+		RenderSplash(w, r)
+		return
+	}
+
+	tags, err := tagTree(db, canSeeHidden(r, st), nil)
+	if err != nil {
+		log.Printf("error getting tags: %v", err)
+	}
+
+	RenderTemplate(w, r, "All Tags", tags, st)
+}
+
+// TagPage is the landing page of a tag, /tag/{name}. aliases and differently written
+// names (GameDev) redirect to the tag's own name
+func TagPage(w http.ResponseWriter, r *http.Request, db *sql.DB, st *sessions.CookieStore) {
+	if !users.IsAuthed(r, st) {
+		RenderSplash(w, r)
+		return
+	}
+
+	typed := strings.TrimPrefix(r.URL.Path, "/tag/")
+	name, err := canonicalTag(db, typed)
+	if err != nil {
+		RenderTemplate(w, r, "NotFound", nil, st)
+		return
+	}
+	if name != typed {
+		http.Redirect(w, r, tagURL(name), http.StatusMovedPermanently)
+		return
+	}
+
+	show_hidden := canSeeHidden(r, st)
+	pages, err := getTagPages(db, name, show_hidden)
+	if err != nil {
+		log.Printf("error getting pages of tag '%v': %v", name, err)
+		RenderTemplate(w, r, "NotFound", nil, st)
+		return
+	}
+	// like the tag list, tags only used by hidden pages stay hidden
+	if len(pages) == 0 && !show_hidden {
+		RenderTemplate(w, r, "NotFound", nil, st)
+		return
+	}
+
+	path, err := tagPath(db, name)
+	if err != nil || len(path) == 0 {
+		log.Printf("error getting path of tag '%v': %v", name, err)
+		RenderTemplate(w, r, "NotFound", nil, st)
+		return
+	}
+
+	summary := TagSummary{
+		Tag:   path[len(path)-1],
+		Path:  path[:len(path)-1],
+		Pages: pages,
+	}
+	summary.PageCount = len(pages)
+	if len(pages) > 0 {
+		summary.LastPost = pages[0].PostTime
+		summary.FirstPost = pages[len(pages)-1].PostTime
+	}
+
+	summary.Aliases, err = getTagAliases(db, summary.ID)
+	if err != nil {
+		log.Printf("error getting aliases of tag '%v': %v", name, err)
+	}
+	summary.Subtags, err = getSubtags(db, summary.ID, show_hidden)
+	if err != nil {
+		log.Printf("error getting subtags of tag '%v': %v", name, err)
+	}
+	summary.Related, err = getRelatedTags(db, name, show_hidden)
+	if err != nil {
+		log.Printf("error getting tags related to '%v': %v", name, err)
+	}
+
+	RenderTemplate(w, r, "Tag", summary, st)
+}
+
+// getManagedTags returns every tag with its page count and aliases
+func getManagedTags(db *sql.DB) ([]Tag, error) {
+	rows, err := db.Query(`
+		SELECT t.id, t.name, t.description, IFNULL(t.parent_id, 0), COUNT(pt.page_id)
+		FROM tags t
+		LEFT JOIN page_tags pt ON pt.tag_id = t.id
+		GROUP BY t.id
+		ORDER BY t.name`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get tags: %w", err)
+	}
+
+	tags := []Tag{}
+	index := map[int64]int{}
+	for rows.Next() {
+		var t Tag
+		err := rows.Scan(&t.ID, &t.Name, &t.Description, &t.ParentID, &t.PageCount)
+		if err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan tag: %w", err)
+		}
+		index[t.ID] = len(tags)
+		tags = append(tags, t)
+	}
+	rows.Close()
+
+	rows, err = db.Query("SELECT alias, tag_id FROM tag_aliases ORDER BY alias")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get tag aliases: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var alias string
+		var tagID int64
+		if err := rows.Scan(&alias, &tagID); err != nil {
+			return nil, fmt.Errorf("failed to scan tag alias: %w", err)
+		}
+		if i, ok := index[tagID]; ok {
+			tags[i].Aliases = append(tags[i].Aliases, alias)
+		}
+	}
+	return tags, rows.Err()
+}
+
+//
+// Tag management (admins)
+//
+
+func TagManagementPage(w http.ResponseWriter, r *http.Request, db *sql.DB, st *sessions.CookieStore) {
+	if !users.IsAdmin(r, st) {
+		log.Printf("non admin attempted to access tag management from: %v", r.Host)
+		RenderTemplate(w, r, "NotFound", nil, st)
+		return
+	}
+
+	tags, err := getManagedTags(db)
+	if err != nil {
+		log.Printf("error getting tags: %v", err)
+	}
+
+	RenderTemplate(w, r, "Tag Management", tags, st)
+}
+
+// tagAdminRequest checks for an admin and reads the tag_id of a tag management request,
+// writing the error if there's a problem
+func tagAdminRequest(w http.ResponseWriter, r *http.Request, st *sessions.CookieStore) (int64, bool) {
+	if !users.IsAdmin(r, st) {
+		log.Printf("non admin attempted to manage tags from: %v", r.Host)
+		http.Error(w, "Admins only", http.StatusForbidden)
+		return 0, false
+	}
+
+	tagID, err := strconv.ParseInt(r.FormValue("tag_id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid tag", http.StatusBadRequest)
+		return 0, false
+	}
+	return tagID, true
+}
+
+// RenameTagHandler renames a tag on every page using it and keeps the old name as an alias,
+// merging into a tag that already has the new name is done with MergeTagHandler instead
+func RenameTagHandler(w http.ResponseWriter, r *http.Request, db *sql.DB, st *sessions.CookieStore) {
+	tagID, ok := tagAdminRequest(w, r, st)
+	if !ok {
+		return
+	}
+
+	name, err := normalizeTag(strings.TrimSpace(r.FormValue("name")))
+	if err != nil {
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		w.Write([]byte("Database error"))
+		return
+	}
+	defer tx.Rollback()
+
+	var old_name string
+	err = tx.QueryRow("SELECT name FROM tags WHERE id = ?", tagID).Scan(&old_name)
+	if err != nil {
+		w.Write([]byte("Tag not found"))
+		return
+	}
+	if old_name == name {
+		w.Header().Set("HX-Refresh", "true")
+		return
+	}
+
+	// going back to one of the tag's own aliases makes it the name again
+	_, err = tx.Exec("DELETE FROM tag_aliases WHERE alias = ? AND tag_id = ?", name, tagID)
+	if err != nil {
+		w.Write([]byte("Database error"))
+		return
+	}
+
+	taken, err := tagNameTaken(tx, name, tagID)
+	if err != nil {
+		w.Write([]byte("Database error"))
+		return
+	}
+	if taken {
+		w.Write([]byte(errTagTaken.Error() + ", merge the tags instead"))
+		return
+	}
+
+	// the old name stays as an alias, so its links, filters and feeds keep working
+	_, err = tx.Exec("UPDATE tags SET name = ? WHERE id = ?", name, tagID)
+	if err == nil {
+		_, err = tx.Exec("INSERT INTO tag_aliases (alias, tag_id) VALUES (?, ?)", old_name, tagID)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Printf("failed to rename tag %v to '%v': %v", tagID, name, err)
+		w.Write([]byte("Error renaming tag"))
+		return
+	}
+
+	w.Header().Set("HX-Refresh", "true")
+}
+
+// MergeTagHandler moves the pages and aliases of a tag to another tag and removes it,
+// its name becomes an alias of the tag it was merged into
+func MergeTagHandler(w http.ResponseWriter, r *http.Request, db *sql.DB, st *sessions.CookieStore) {
+	tagID, ok := tagAdminRequest(w, r, st)
+	if !ok {
+		return
+	}
+
+	intoID, err := strconv.ParseInt(r.FormValue("into"), 10, 64)
+	if err != nil || intoID == tagID {
+		w.Write([]byte("Pick another tag to merge into"))
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		w.Write([]byte("Database error"))
+		return
+	}
+	defer tx.Rollback()
+
+	var name, description string
+	err = tx.QueryRow("SELECT name, description FROM tags WHERE id = ?", tagID).Scan(&name, &description)
+	if err != nil {
+		w.Write([]byte("Tag not found"))
+		return
+	}
+
+	var exists bool
+	err = tx.QueryRow("SELECT EXISTS(SELECT 1 FROM tags WHERE id = ?)", intoID).Scan(&exists)
+	if err != nil || !exists {
+		w.Write([]byte("Tag to merge into not found"))
+		return
+	}
+
+	// merging into a tag under this one moves it up to where this tag was first
+	under, err := tagUnder(tx, intoID, tagID)
+	if err != nil {
+		log.Printf("failed to merge tag %v into %v: %v", tagID, intoID, err)
+		w.Write([]byte("Error merging tags"))
+		return
+	}
+	if under {
+		_, err = tx.Exec("UPDATE tags SET parent_id = (SELECT parent_id FROM tags WHERE id = ?) WHERE id = ?", tagID, intoID)
+		if err != nil {
+			log.Printf("failed to merge tag %v into %v: %v", tagID, intoID, err)
+			w.Write([]byte("Error merging tags"))
+			return
+		}
+	}
+
+	queries := []struct {
+		query string
+		args  []interface{}
+	}{
+		{"INSERT OR IGNORE INTO page_tags (page_id, tag_id) SELECT page_id, ?1 FROM page_tags WHERE tag_id = ?2", []interface{}{intoID, tagID}},
+		{"DELETE FROM page_tags WHERE tag_id = ?", []interface{}{tagID}},
+		{"UPDATE tag_aliases SET tag_id = ? WHERE tag_id = ?", []interface{}{intoID, tagID}},
+		{"UPDATE tags SET parent_id = ? WHERE parent_id = ?", []interface{}{intoID, tagID}},
+		{"UPDATE tags SET description = ? WHERE id = ? AND description = ''", []interface{}{description, intoID}},
+		{"DELETE FROM tags WHERE id = ?", []interface{}{tagID}},
+		{"INSERT INTO tag_aliases (alias, tag_id) VALUES (?, ?)", []interface{}{name, intoID}},
+	}
+
+	for _, q := range queries {
+		_, err = tx.Exec(q.query, q.args...)
+		if err != nil {
+			log.Printf("failed to merge tag %v into %v: %v", tagID, intoID, err)
+			w.Write([]byte("Error merging tags"))
+			return
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		w.Write([]byte("Error merging tags"))
+		return
+	}
+
+	w.Header().Set("HX-Refresh", "true")
+}
+
+func DescribeTagHandler(w http.ResponseWriter, r *http.Request, db *sql.DB, st *sessions.CookieStore) {
+	tagID, ok := tagAdminRequest(w, r, st)
+	if !ok {
+		return
+	}
+
+	_, err := db.Exec("UPDATE tags SET description = ? WHERE id = ?", strings.TrimSpace(r.FormValue("description")), tagID)
+	if err != nil {
+		log.Printf("failed to describe tag %v: %v", tagID, err)
+		w.Write([]byte("Error saving description"))
+		return
+	}
+
+	w.Write([]byte("Saved"))
+}
+
+// SetTagParentHandler puts a tag under another one, or back at the top level when parent is 0
+func SetTagParentHandler(w http.ResponseWriter, r *http.Request, db *sql.DB, st *sessions.CookieStore) {
+	tagID, ok := tagAdminRequest(w, r, st)
+	if !ok {
+		return
+	}
+
+	parentID, err := strconv.ParseInt(r.FormValue("parent"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid parent tag", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		w.Write([]byte("Database error"))
+		return
+	}
+	defer tx.Rollback()
+
+	var parent sql.NullInt64
+	if parentID != 0 {
+		var exists bool
+		err = tx.QueryRow("SELECT EXISTS(SELECT 1 FROM tags WHERE id = ?)", parentID).Scan(&exists)
+		if err != nil || !exists {
+			w.Write([]byte("Parent tag not found"))
+			return
+		}
+
+		// a tag can't go under itself or a tag under it
+		under, err := tagUnder(tx, parentID, tagID)
+		if err != nil {
+			log.Printf("failed to check parent of tag %v: %v", tagID, err)
+			w.Write([]byte("Error setting parent"))
+			return
+		}
+		if under {
+			w.Write([]byte("A tag can't be under itself or one of its subtags"))
+			return
+		}
+		parent = sql.NullInt64{Int64: parentID, Valid: true}
+	}
+
+	_, err = tx.Exec("UPDATE tags SET parent_id = ? WHERE id = ?", parent, tagID)
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Printf("failed to set parent of tag %v: %v", tagID, err)
+		w.Write([]byte("Error setting parent"))
+		return
+	}
+
+	w.Header().Set("HX-Refresh", "true")
+}
+
+// tagUnder reports whether tagID is ancestorID or a tag under it
+func tagUnder(tx *sql.Tx, tagID int64, ancestorID int64) (bool, error) {
+	var under bool
+	err := tx.QueryRow(`
+		WITH RECURSIVE above(id, depth) AS (
+			SELECT ?1, 0
+			UNION
+			SELECT t.parent_id, above.depth + 1 FROM tags t JOIN above ON t.id = above.id
+			WHERE t.parent_id IS NOT NULL AND above.depth < ?3
+		)
+		SELECT EXISTS(SELECT 1 FROM above WHERE id = ?2)`, tagID, ancestorID, MAX_TAG_DEPTH).Scan(&under)
+	return under, err
+}
+
+func AddTagAliasHandler(w http.ResponseWriter, r *http.Request, db *sql.DB, st *sessions.CookieStore) {
+	tagID, ok := tagAdminRequest(w, r, st)
+	if !ok {
+		return
+	}
+
+	alias, err := normalizeTag(strings.TrimSpace(r.FormValue("alias")))
+	if err != nil {
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		w.Write([]byte("Database error"))
+		return
+	}
+	defer tx.Rollback()
+
+	// pages already using a tag by that name are left to a merge
+	taken, err := tagNameTaken(tx, alias, 0)
+	if err != nil {
+		w.Write([]byte("Database error"))
+		return
+	}
+	if taken {
+		w.Write([]byte(errTagTaken.Error() + ", merge the tags instead"))
+		return
+	}
+
+	_, err = tx.Exec("INSERT INTO tag_aliases (alias, tag_id) VALUES (?, ?)", alias, tagID)
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Printf("failed to add alias '%v' to tag %v: %v", alias, tagID, err)
+		w.Write([]byte("Error adding alias"))
+		return
+	}
+
+	w.Header().Set("HX-Refresh", "true")
+}
+
+func RemoveTagAliasHandler(w http.ResponseWriter, r *http.Request, db *sql.DB, st *sessions.CookieStore) {
+	if !users.IsAdmin(r, st) {
+		log.Printf("non admin attempted to manage tags from: %v", r.Host)
+		http.Error(w, "Admins only", http.StatusForbidden)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		w.Write([]byte("Database error"))
+		return
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("DELETE FROM tag_aliases WHERE alias = ?", r.FormValue("alias"))
+	if err == nil {
+		err = cleanUpTags(tx)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Printf("failed to remove tag alias '%v': %v", r.FormValue("alias"), err)
+		w.Write([]byte("Error removing alias"))
+		return
+	}
+
+	w.Header().Set("HX-Refresh", "true")
+}
+
+// NormalizeExistingTags brings tags and aliases saved before tags were normalized to their
+// normalized form (see cleanTag). tags that end up with the same name are merged, tags
+// with nothing left are removed along with aliases that clash
+func NormalizeExistingTags(db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	type tag struct {
+		id          int64
+		name        string
+		description string
+	}
+	rows, err := tx.Query("SELECT id, name, description FROM tags ORDER BY id")
+	if err != nil {
+		return fmt.Errorf("failed to get tags: %w", err)
+	}
+	var tags []tag
+	ids := map[string]int64{}
+	for rows.Next() {
+		var t tag
+		if err := rows.Scan(&t.id, &t.name, &t.description); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan tag: %w", err)
+		}
+		tags = append(tags, t)
+		ids[t.name] = t.id
+	}
+	rows.Close()
+
+	for _, t := range tags {
+		clean := cleanTag(t.name)
+		if clean == t.name {
+			continue
+		}
+		delete(ids, t.name)
+
+		// tags named like an alias are merged into the alias' tag
+		into, merge := ids[clean]
+		if !merge && clean != "" {
+			err = tx.QueryRow("SELECT tag_id FROM tag_aliases WHERE alias = ?", clean).Scan(&into)
+			if err != nil && err != sql.ErrNoRows {
+				return fmt.Errorf("failed to check aliases for tag '%s': %w", t.name, err)
+			}
+			merge = err == nil && into != t.id
+		}
+
+		var queries []string
+		switch {
+		case clean == "":
+			queries = []string{
+				"DELETE FROM page_tags WHERE tag_id = ?1",
+				"DELETE FROM tag_aliases WHERE tag_id = ?1",
+				"DELETE FROM tags WHERE id = ?1",
+			}
+		case merge:
+			queries = []string{
+				"INSERT OR IGNORE INTO page_tags (page_id, tag_id) SELECT page_id, ?2 FROM page_tags WHERE tag_id = ?1",
+				"DELETE FROM page_tags WHERE tag_id = ?1",
+				"UPDATE tag_aliases SET tag_id = ?2 WHERE tag_id = ?1",
+				"UPDATE tags SET description = ?4 WHERE id = ?2 AND description = ''",
+				"DELETE FROM tags WHERE id = ?1",
+			}
+		default:
+			queries = []string{
+				"DELETE FROM tag_aliases WHERE alias = ?3",
+				"UPDATE tags SET name = ?3 WHERE id = ?1",
+			}
+			ids[clean] = t.id
+		}
+
+		for _, q := range queries {
+			_, err = tx.Exec(q, t.id, into, clean, t.description)
+			if err != nil {
+				return fmt.Errorf("failed to normalize tag '%s': %w", t.name, err)
+			}
+		}
+	}
+
+	// aliases that clash with a tag or another alias once normalized are dropped
+	rows, err = tx.Query("SELECT alias FROM tag_aliases")
+	if err != nil {
+		return fmt.Errorf("failed to get tag aliases: %w", err)
+	}
+	var aliases []string
+	for rows.Next() {
+		var alias string
+		if err := rows.Scan(&alias); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan tag alias: %w", err)
+		}
+		aliases = append(aliases, alias)
+	}
+	rows.Close()
+
+	for _, alias := range aliases {
+		clean := cleanTag(alias)
+		if clean == alias {
+			continue
+		}
+		var taken bool
+		if clean != "" {
+			taken, err = tagNameTaken(tx, clean, 0)
+			if err != nil {
+				return fmt.Errorf("failed to check tag alias '%s': %w", alias, err)
+			}
+		}
+		if clean == "" || taken {
+			_, err = tx.Exec("DELETE FROM tag_aliases WHERE alias = ?", alias)
+		} else {
+			_, err = tx.Exec("UPDATE tag_aliases SET alias = ? WHERE alias = ?", clean, alias)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to normalize tag alias '%s': %w", alias, err)
+		}
+	}
+
+	// not cleanUpTags, this runs on the 1.17 schema (before tags had parents) and has to keep doing so
+	_, err = tx.Exec(`
+		DELETE FROM tags
+		WHERE NOT EXISTS (SELECT 1 FROM page_tags WHERE page_tags.tag_id = tags.id)
+			AND description = ''
+			AND NOT EXISTS (SELECT 1 FROM tag_aliases WHERE tag_aliases.tag_id = tags.id)`)
+	if err != nil {
+		return fmt.Errorf("failed to clean up tags: %w", err)
+	}
+	return tx.Commit()
+}
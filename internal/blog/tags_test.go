@@ -0,0 +1,148 @@
+package blog
+
+import (
+	// golang
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestNormalizeTag(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    string
+		wantErr bool
+	}{
+		{"gamedev", "gamedev", false},
+		{"GameDev", "gamedev", false},
+		{"game-dev", "game-dev", false},
+		{"game_dev", "game_dev", false},
+		{"2024", "2024", false},
+		{"ＧａｍｅＤｅｖ", "gamedev", false}, // full width
+		{"ﬁlm", "film", false},           // ligature
+		{"Straße", "strasse", false},
+		{"Café", "café", false},
+		{"Cafe\u0301", "café", false}, // decomposed accent composes to the same tag
+		{"日本語", "日本語", false},
+		{"ΣΊΣΥΦΟΣ", "σίσυφοσ", false},
+		{"हिन्दी", "हिन्दी", false},
+		{strings.Repeat("a", MAX_TAG_LENGTH), strings.Repeat("a", MAX_TAG_LENGTH), false},
+		{strings.Repeat("日", MAX_TAG_LENGTH), strings.Repeat("日", MAX_TAG_LENGTH), false},
+
+		{strings.Repeat("a", MAX_TAG_LENGTH+1), "", true},
+		{"c++", "", true},
+		{"game dev", "", true},
+		{"game.dev", "", true},
+		{"-gamedev", "", true}, // would read as an exclusion
+		{"---", "", true},
+		{"_", "", true},
+		{"🎮", "", true},
+		{"", "", true},
+	}
+
+	for _, tt := range tests {
+		got, err := normalizeTag(tt.name)
+		if tt.wantErr {
+			var tag_err tagError
+			if !errors.As(err, &tag_err) {
+				t.Errorf("normalizeTag(%q) = %q, %v, want a tagError", tt.name, got, err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("normalizeTag(%q) = %q, %v, want %q", tt.name, got, err, tt.want)
+		}
+	}
+}
+
+func TestParseTags(t *testing.T) {
+	tests := []struct {
+		field string
+		want  []string
+	}{
+		{"", []string{}},
+		{"   ", []string{}},
+		{"go rust", []string{"go", "rust"}},
+		{"go,rust", []string{"go", "rust"}},
+		{" go , rust ,, zig ", []string{"go", "rust", "zig"}},
+		{"Go go GO", []string{"go"}},
+		{"gamedev GameDev ＧＡＭＥＤＥＶ art", []string{"gamedev", "art"}},
+		{"Café Cafe\u0301", []string{"café"}},
+	}
+
+	for _, tt := range tests {
+		got, err := parseTags(tt.field)
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseTags(%q) = %q, %v, want %q", tt.field, got, err, tt.want)
+		}
+	}
+}
+
+func TestParseTagsErrors(t *testing.T) {
+	many := []string{}
+	for i := 0; i <= MAX_PAGE_TAGS; i++ {
+		many = append(many, strings.Repeat("t", i+1))
+	}
+	repeated := strings.Repeat("same ", MAX_PAGE_TAGS+5)
+
+	if _, err := parseTags(strings.Join(many, " ")); err != errTooManyTags {
+		t.Errorf("parseTags with %v tags = %v, want errTooManyTags", len(many), err)
+	}
+	if got, err := parseTags(repeated); err != nil || len(got) != 1 {
+		t.Errorf("parseTags of one repeated tag = %q, %v, want one tag", got, err)
+	}
+	if _, err := parseTags("fine c++ also-fine"); err == nil || !strings.Contains(err.Error(), "c++") {
+		t.Errorf("parseTags with an invalid tag = %v, want an error naming it", err)
+	}
+}
+
+func TestCleanTag(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"gamedev", "gamedev"},
+		{"GameDev", "gamedev"},
+		{"c++", "c"},
+		{"C#", "c"},
+		{"game dev", "game-dev"},
+		{"game...dev", "game-dev"},
+		{"-gamedev-", "gamedev"},
+		{"__init__", "init"},
+		{"ＧａｍｅＤｅｖ", "gamedev"},
+		{"日本語!", "日本語"},
+		{"🎮", ""},
+		{"+++", ""},
+		{"-_-", ""},
+		{"", ""},
+	}
+
+	for _, tt := range tests {
+		if got := cleanTag(tt.name); got != tt.want {
+			t.Errorf("cleanTag(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCleanTagIsNormalized(t *testing.T) {
+	// whatever cleanTag keeps has to pass normalizeTag unchanged
+	names := []string{
+		"GameDev", "c++", "game dev", "C# / .NET", "--x--",
+		strings.Repeat("a", MAX_TAG_LENGTH+10),
+		strings.Repeat("ab ", MAX_TAG_LENGTH),
+		strings.Repeat("日", MAX_TAG_LENGTH+10),
+		strings.Repeat("é", MAX_TAG_LENGTH+10),
+	}
+
+	for _, name := range names {
+		tag := cleanTag(name)
+		if n := utf8.RuneCountInString(tag); n > MAX_TAG_LENGTH {
+			t.Errorf("cleanTag(%.10q...) is %v characters, want at most %v", name, n, MAX_TAG_LENGTH)
+		}
+		if got, err := normalizeTag(tag); err != nil || got != tag {
+			t.Errorf("normalizeTag(cleanTag(%.10q...)) = %q, %v, want %q", name, got, err, tag)
+		}
+	}
+}
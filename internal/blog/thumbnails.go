@@ -0,0 +1,135 @@
+package blog
+
+import (
+	// internal
+	"blog/internal/jobs"
+	"blog/internal/users"
+
+	// golang
+	"database/sql"
+	"fmt"
+	"image"
+	"log"
+	"net/http"
+	"strconv"
+
+	// externals
+	"github.com/gorilla/sessions"
+)
+
+// FocalPoint is the spot kept in view when an image is cropped to a square thumbnail,
+// as fractions of the image width/height
+type FocalPoint struct {
+	X float64
+	Y float64
+}
+
+// thumbnails were always cropped from the top before focal points existed
+var DEFAULT_FOCUS = FocalPoint{X: 0.5, Y: 0}
+
+// named anchors offered on the upload form
+var focusAnchors = map[string]FocalPoint{
+	"top-left":     {0, 0},
+	"top":          {0.5, 0},
+	"top-right":    {1, 0},
+	"left":         {0, 0.5},
+	"center":       {0.5, 0.5},
+	"right":        {1, 0.5},
+	"bottom-left":  {0, 1},
+	"bottom":       {0.5, 1},
+	"bottom-right": {1, 1},
+}
+
+// parseFocus reads a focal point from form values, an exact x/y (0-1) wins over a named anchor
+func parseFocus(anchor string, x string, y string) FocalPoint {
+	fx, err_x := strconv.ParseFloat(x, 64)
+	fy, err_y := strconv.ParseFloat(y, 64)
+	if err_x == nil && err_y == nil && fx >= 0 && fx <= 1 && fy >= 0 && fy <= 1 {
+		return FocalPoint{fx, fy}
+	}
+	if focus, ok := focusAnchors[anchor]; ok {
+		return focus
+	}
+	return DEFAULT_FOCUS
+}
+
+// decodeForThumbnail decodes a stored image upright, or the first frame of an animation
+func decodeForThumbnail(file_bytes []byte) (image.Image, error) {
+	if isAnimated(file_bytes) {
+		return decodeFirstFrame(file_bytes)
+	}
+	return decodeOriented(file_bytes)
+}
+
+// queueAllThumbnails queues a new thumbnail for every page image and video poster,
+// returns the queued job ids
+func queueAllThumbnails(db *sql.DB, q *jobs.Queue, owner string) ([]int64, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var todo []any
+	rows, err := tx.Query("SELECT DISTINCT page_id, media_hash FROM page_images")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get page images: %w", err)
+	}
+	for rows.Next() {
+		var job imageJob
+		if err := rows.Scan(&job.PageID, &job.Hash); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan page image: %w", err)
+		}
+		todo = append(todo, job)
+	}
+	rows.Close()
+
+	rows, err = tx.Query("SELECT id FROM page_videos WHERE poster != ''")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get video posters: %w", err)
+	}
+	for rows.Next() {
+		var job posterJob
+		if err := rows.Scan(&job.VideoID); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan video poster: %w", err)
+		}
+		todo = append(todo, job)
+	}
+	rows.Close()
+
+	var ids []int64
+	for _, job := range todo {
+		kind := JOB_IMAGE_DERIVATIVES
+		if _, ok := job.(posterJob); ok {
+			kind = JOB_POSTER_THUMBNAIL
+		}
+		id, err := q.EnqueueTx(tx, kind, job, owner)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, tx.Commit()
+}
+
+func RegenerateThumbnailsHandler(w http.ResponseWriter, r *http.Request, db *sql.DB, st *sessions.CookieStore, q *jobs.Queue) {
+	if !users.IsAdmin(r, st) {
+		log.Printf("non admin attempted to regenerate thumbnails: %v", r.Host)
+		w.Write([]byte("Unauthorized access"))
+		return
+	}
+
+	username, _ := users.GetCurrentUsername(r, st)
+	ids, err := queueAllThumbnails(db, q, username)
+	if err != nil {
+		log.Printf("error queueing thumbnails: %v", err)
+		w.Write([]byte("Error regenerating thumbnails"))
+		return
+	}
+	q.Wake()
+
+	w.Write([]byte(fmt.Sprintf("Queued %v thumbnails", len(ids)) + jobs.PollingStatus(ids)))
+}
@@ -0,0 +1,116 @@
+package blog
+
+import (
+	// internal
+	"blog/internal/users"
+
+	// golang
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+
+	// externals
+	"github.com/gorilla/sessions"
+	_ "golang.org/x/image/webp"
+)
+
+const (
+	UPLOADER_MAX_UPLOAD_SIZE int64 = 25 << 20 // non admin uploaders, admins get MAX_UPLOAD_SIZE
+	MAX_FORM_MEMORY          int64 = 10 << 20 // multipart parts past this spill to temp files
+
+	MAX_IMAGE_DIMENSION int = 12000
+	MAX_IMAGE_PIXELS    int = 50_000_000 // ~200mb once decoded, guards against decompression bombs
+)
+
+// sniffed types accepted as page images
+var ALLOWED_IMAGE_TYPES = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/gif":  true,
+	"image/webp": true,
+}
+
+// uploadError is a rejected upload, sent back to the form with its status code
+type uploadError struct {
+	Status  int
+	Message string
+}
+
+func (e *uploadError) Error() string {
+	return e.Message
+}
+
+// maxUploadSize is the request size limit for the current user's role
+func maxUploadSize(r *http.Request, st *sessions.CookieStore) int64 {
+	if users.IsAdmin(r, st) {
+		return MAX_UPLOAD_SIZE
+	}
+	return UPLOADER_MAX_UPLOAD_SIZE
+}
+
+// parseUploadForm parses a multipart upload, refusing bodies over the user's size limit
+func parseUploadForm(w http.ResponseWriter, r *http.Request, st *sessions.CookieStore) error {
+	limit := maxUploadSize(r, st)
+	r.Body = http.MaxBytesReader(w, r.Body, limit)
+
+	err := r.ParseMultipartForm(MAX_FORM_MEMORY)
+	if err != nil {
+		var max_err *http.MaxBytesError
+		if errors.As(err, &max_err) {
+			return &uploadError{http.StatusRequestEntityTooLarge, fmt.Sprintf("Upload too large, the limit for your account is %v MB", limit>>20)}
+		}
+		return &uploadError{http.StatusBadRequest, "Invalid request - could not read upload form"}
+	}
+	return nil
+}
+
+// validateImage checks an uploaded file's type and dimensions before it is read
+// into memory or decoded, the file is rewound afterwards
+func validateImage(file multipart.File, name string) error {
+	head := make([]byte, 512)
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return &uploadError{http.StatusBadRequest, fmt.Sprintf("'%v' could not be read", name)}
+	}
+
+	mime_type := http.DetectContentType(head[:n])
+	if !ALLOWED_IMAGE_TYPES[mime_type] {
+		return &uploadError{http.StatusUnsupportedMediaType, fmt.Sprintf("'%v' is not a supported image type (%v), use jpeg, png, gif or webp", name, mime_type)}
+	}
+
+	_, err = file.Seek(0, io.SeekStart)
+	if err != nil {
+		return fmt.Errorf("error rewinding '%v': %w", name, err)
+	}
+
+	// only reads the header, so a small file claiming huge dimensions is caught here
+	cfg, _, err := image.DecodeConfig(file)
+	if err != nil {
+		return &uploadError{http.StatusUnprocessableEntity, fmt.Sprintf("'%v' is not a valid image", name)}
+	}
+	if cfg.Width > MAX_IMAGE_DIMENSION || cfg.Height > MAX_IMAGE_DIMENSION || cfg.Width*cfg.Height > MAX_IMAGE_PIXELS {
+		return &uploadError{http.StatusUnprocessableEntity, fmt.Sprintf("'%v' is too large (%vx%v), max %vpx per side and %v megapixels", name, cfg.Width, cfg.Height, MAX_IMAGE_DIMENSION, MAX_IMAGE_PIXELS/1_000_000)}
+	}
+
+	_, err = file.Seek(0, io.SeekStart)
+	if err != nil {
+		return fmt.Errorf("error rewinding '%v': %w", name, err)
+	}
+	return nil
+}
+
+// writeUploadError sends a rejection with its status, anything else is logged as a 500
+func writeUploadError(w http.ResponseWriter, err error) {
+	var upload_err *uploadError
+	if errors.As(err, &upload_err) {
+		http.Error(w, upload_err.Message, upload_err.Status)
+		return
+	}
+	log.Printf("error processing upload: %v", err)
+	http.Error(w, "Error processing images", http.StatusInternalServerError)
+}
@@ -0,0 +1,142 @@
+package blog
+
+import (
+	// internal
+	"blog/internal/media"
+
+	// golang
+	"database/sql"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+)
+
+// sniffed types accepted as page videos, served from /media/ with range support
+var ALLOWED_VIDEO_TYPES = map[string]bool{
+	"video/mp4":  true,
+	"video/webm": true,
+}
+
+// PageVideo is a video attached to a page, match page_videos table
+type PageVideo struct {
+	ID              int64
+	Position        int
+	Hash            string
+	MimeType        string
+	Poster          string // optional poster image, also the home thumbnail of video only pages
+	PosterThumbnail string
+}
+
+// storedVideo is an uploaded video and its optional poster
+type storedVideo struct {
+	Name     string
+	Hash     string
+	MimeType string
+	Poster   *storedImage
+}
+
+// validateVideo sniffs an uploaded video against ALLOWED_VIDEO_TYPES, the file is rewound afterwards
+func validateVideo(file multipart.File, name string) (string, error) {
+	head := make([]byte, 512)
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return "", &uploadError{http.StatusBadRequest, fmt.Sprintf("'%v' could not be read", name)}
+	}
+
+	mime_type := http.DetectContentType(head[:n])
+	if !ALLOWED_VIDEO_TYPES[mime_type] {
+		return "", &uploadError{http.StatusUnsupportedMediaType, fmt.Sprintf("'%v' is not a supported video type (%v), use mp4 or webm", name, mime_type)}
+	}
+
+	_, err = file.Seek(0, io.SeekStart)
+	if err != nil {
+		return "", fmt.Errorf("error rewinding '%v': %w", name, err)
+	}
+	return mime_type, nil
+}
+
+// readVideoUpload stores the video in field (nil if none was sent) along with
+// the poster image in poster_field, the video is streamed to disk as is
+func readVideoUpload(r *http.Request, ms *media.Store, field string, poster_field string) (*storedVideo, error) {
+	if r.MultipartForm == nil || len(r.MultipartForm.File[field]) == 0 {
+		return nil, nil
+	}
+	header := r.MultipartForm.File[field][0]
+
+	file, err := header.Open()
+	if err != nil {
+		return nil, fmt.Errorf("error opening '%v': %w", header.Filename, err)
+	}
+	defer file.Close()
+
+	mime_type, err := validateVideo(file, header.Filename)
+	if err != nil {
+		return nil, err
+	}
+
+	hash, err := ms.Put(file, mime_type)
+	if err != nil {
+		return nil, fmt.Errorf("error storing '%v': %w", header.Filename, err)
+	}
+	video := &storedVideo{Name: header.Filename, Hash: hash, MimeType: mime_type}
+
+	posters, err := readImageUploads(r, ms, poster_field, DEFAULT_FOCUS)
+	if err != nil {
+		return nil, err
+	}
+	if len(posters) > 0 {
+		video.Poster = &posters[0]
+	}
+
+	return video, nil
+}
+
+// addPageVideo appends a video to the end of a page's videos, the poster thumbnail
+// is made later by a poster job
+func addPageVideo(tx *sql.Tx, pageID int64, video *storedVideo) (int64, error) {
+	var poster string
+	if video.Poster != nil {
+		poster = video.Poster.Hash
+	}
+
+	result, err := tx.Exec(`
+		INSERT INTO page_videos (page_id, position, media_hash, mime_type, poster)
+		VALUES (?, (SELECT COALESCE(MAX(position) + 1, 0) FROM page_videos WHERE page_id = ?), ?, ?, ?)`,
+		pageID, pageID, video.Hash, video.MimeType, poster)
+	if err != nil {
+		return 0, fmt.Errorf("failed to add video: %w", err)
+	}
+	return result.LastInsertId()
+}
+
+func removePageVideo(tx *sql.Tx, pageID int64, videoID int64) error {
+	_, err := tx.Exec("DELETE FROM page_videos WHERE id = ? AND page_id = ?", videoID, pageID)
+	if err != nil {
+		return fmt.Errorf("failed to remove video %v: %w", videoID, err)
+	}
+	return nil
+}
+
+func getPageVideos(db *sql.DB, pageID int64) ([]PageVideo, error) {
+	rows, err := db.Query(`
+		SELECT id, position, media_hash, mime_type, poster, poster_thumbnail
+		FROM page_videos
+		WHERE page_id = ?
+		ORDER BY position`, pageID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var videos []PageVideo
+	for rows.Next() {
+		var v PageVideo
+		err := rows.Scan(&v.ID, &v.Position, &v.Hash, &v.MimeType, &v.Poster, &v.PosterThumbnail)
+		if err != nil {
+			return nil, err
+		}
+		videos = append(videos, v)
+	}
+	return videos, nil
+}
@@ -0,0 +1,358 @@
+package jobs
+
+import (
+	// internal
+	"blog/internal/users"
+
+	// golang
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	// externals
+	"github.com/gorilla/sessions"
+)
+
+const (
+	STATUS_QUEUED  = "queued"
+	STATUS_RUNNING = "running"
+	STATUS_DONE    = "done"
+	STATUS_FAILED  = "failed"
+
+	MAX_ATTEMPTS  int           = 5
+	RETRY_BACKOFF time.Duration = 5 * time.Second // doubled after each failed attempt
+	MAX_BACKOFF   time.Duration = 10 * time.Minute
+	POLL_INTERVAL time.Duration = time.Second
+	KEEP_FINISHED time.Duration = 7 * 24 * time.Hour // finished jobs are cleared at startup after this
+)
+
+// Handler runs one job, an error retries it later with backoff until MAX_ATTEMPTS
+type Handler func(ctx context.Context, payload []byte) error
+
+// Job is a unit of background work, match jobs table
+type Job struct {
+	ID          int64
+	Kind        string
+	Payload     []byte
+	Owner       string // username of whoever queued it, only they (and admins) can see its status
+	Status      string
+	Attempts    int
+	MaxAttempts int
+	LastError   string
+}
+
+// Queue is a persistent job queue in the jobs table, worked by a fixed number of goroutines
+type Queue struct {
+	db       *sql.DB
+	workers  int
+	handlers map[string]Handler
+
+	wake     chan struct{}
+	draining chan struct{} // closed by Shutdown, workers exit once nothing is due
+	ctx      context.Context
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+}
+
+func NewQueue(db *sql.DB, workers int) *Queue {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Queue{
+		db:       db,
+		workers:  workers,
+		handlers: map[string]Handler{},
+		wake:     make(chan struct{}, 1),
+		draining: make(chan struct{}),
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+}
+
+// Register sets the handler for a kind of job, call before Start
+func (q *Queue) Register(kind string, h Handler) {
+	q.handlers[kind] = h
+}
+
+// Start requeues jobs interrupted by the last shutdown, clears old finished jobs and starts the workers
+func (q *Queue) Start() error {
+	_, err := q.db.Exec("UPDATE jobs SET status = ? WHERE status = ?", STATUS_QUEUED, STATUS_RUNNING)
+	if err != nil {
+		return fmt.Errorf("failed to requeue interrupted jobs: %w", err)
+	}
+
+	_, err = q.db.Exec("DELETE FROM jobs WHERE status IN (?, ?) AND updated < ?",
+		STATUS_DONE, STATUS_FAILED, time.Now().Add(-KEEP_FINISHED).UTC().Format(time.DateTime))
+	if err != nil {
+		return fmt.Errorf("failed to clear finished jobs: %w", err)
+	}
+
+	for i := 0; i < q.workers; i++ {
+		q.wg.Add(1)
+		go q.work()
+	}
+	return nil
+}
+
+// Shutdown stops taking new work once nothing is due and waits for the workers. jobs still
+// waiting on a retry stay queued for the next start. if ctx ends first running jobs are
+// cancelled, and requeued on the next start
+func (q *Queue) Shutdown(ctx context.Context) error {
+	close(q.draining)
+
+	done := make(chan struct{})
+	go func() {
+		q.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		q.cancel()
+		return ctx.Err()
+	}
+}
+
+// Wake has an idle worker look for jobs now rather than at its next poll
+func (q *Queue) Wake() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Enqueue adds a job, payload is stored as json
+func (q *Queue) Enqueue(kind string, payload any, owner string) (int64, error) {
+	id, err := enqueue(q.db, kind, payload, owner)
+	if err == nil {
+		q.Wake()
+	}
+	return id, err
+}
+
+// EnqueueTx adds a job as part of tx, it runs once tx commits (call Wake after to skip the poll wait)
+func (q *Queue) EnqueueTx(tx *sql.Tx, kind string, payload any, owner string) (int64, error) {
+	return enqueue(tx, kind, payload, owner)
+}
+
+type execer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
+func enqueue(db execer, kind string, payload any, owner string) (int64, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return 0, fmt.Errorf("failed to encode %v job: %w", kind, err)
+	}
+
+	result, err := db.Exec(`
+		INSERT INTO jobs (kind, payload, owner, status, max_attempts, run_at)
+		VALUES (?, ?, ?, ?, ?, ?)`,
+		kind, string(data), owner, STATUS_QUEUED, MAX_ATTEMPTS, time.Now().Unix())
+	if err != nil {
+		return 0, fmt.Errorf("failed to queue %v job: %w", kind, err)
+	}
+	return result.LastInsertId()
+}
+
+func (q *Queue) work() {
+	defer q.wg.Done()
+
+	for q.ctx.Err() == nil {
+		job, err := q.claim()
+		if err != nil {
+			log.Printf("error claiming job: %v", err)
+		}
+		if job != nil {
+			q.run(job)
+			continue
+		}
+
+		select {
+		case <-q.draining:
+			return
+		case <-q.ctx.Done():
+			return
+		case <-q.wake:
+		case <-time.After(POLL_INTERVAL):
+		}
+	}
+}
+
+// claim marks the next due job as running
+func (q *Queue) claim() (*Job, error) {
+	var job Job
+	var payload string
+	err := q.db.QueryRow(`
+		UPDATE jobs
+		SET status = ?, attempts = attempts + 1, updated = CURRENT_TIMESTAMP
+		WHERE id = (
+			SELECT id FROM jobs
+			WHERE status = ? AND run_at <= ?
+			ORDER BY run_at, id LIMIT 1)
+		RETURNING id, kind, payload, owner, attempts, max_attempts`,
+		STATUS_RUNNING, STATUS_QUEUED, time.Now().Unix()).
+		Scan(&job.ID, &job.Kind, &payload, &job.Owner, &job.Attempts, &job.MaxAttempts)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	job.Payload = []byte(payload)
+	job.Status = STATUS_RUNNING
+	return &job, nil
+}
+
+func (q *Queue) run(job *Job) {
+	err := q.call(job)
+	if err != nil && q.ctx.Err() != nil {
+		return // cancelled by Shutdown, left running to be requeued on the next start
+	}
+
+	switch {
+	case err == nil:
+		_, err = q.db.Exec("UPDATE jobs SET status = ?, last_error = '', updated = CURRENT_TIMESTAMP WHERE id = ?",
+			STATUS_DONE, job.ID)
+
+	case job.Attempts >= job.MaxAttempts:
+		log.Printf("job %v (%v) failed for good after %v attempts: %v", job.ID, job.Kind, job.Attempts, err)
+		_, err = q.db.Exec("UPDATE jobs SET status = ?, last_error = ?, updated = CURRENT_TIMESTAMP WHERE id = ?",
+			STATUS_FAILED, err.Error(), job.ID)
+
+	default:
+		backoff := min(RETRY_BACKOFF<<(job.Attempts-1), MAX_BACKOFF)
+		log.Printf("job %v (%v) failed, attempt %v of %v, retrying in %v: %v", job.ID, job.Kind, job.Attempts, job.MaxAttempts, backoff, err)
+		_, err = q.db.Exec("UPDATE jobs SET status = ?, last_error = ?, run_at = ?, updated = CURRENT_TIMESTAMP WHERE id = ?",
+			STATUS_QUEUED, err.Error(), time.Now().Add(backoff).Unix(), job.ID)
+	}
+	if err != nil {
+		log.Printf("error recording result of job %v: %v", job.ID, err)
+	}
+}
+
+// call runs the job's handler, a panic counts as a failed attempt
+func (q *Queue) call(job *Job) (err error) {
+	h, ok := q.handlers[job.Kind]
+	if !ok {
+		return fmt.Errorf("no handler for job kind '%v'", job.Kind)
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return h(q.ctx, job.Payload)
+}
+
+// Get returns the jobs with the given ids that exist
+func (q *Queue) Get(ids []int64) ([]Job, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	args := make([]any, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	rows, err := q.db.Query(`
+		SELECT id, kind, owner, status, attempts, max_attempts, last_error
+		FROM jobs
+		WHERE id IN (?`+strings.Repeat(", ?", len(ids)-1)+`)
+		ORDER BY id`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var jobs []Job
+	for rows.Next() {
+		var job Job
+		err := rows.Scan(&job.ID, &job.Kind, &job.Owner, &job.Status, &job.Attempts, &job.MaxAttempts, &job.LastError)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, nil
+}
+
+//
+// Status (htmx)
+//
+
+// PollingStatus is an htmx element showing the progress of jobs, it polls StatusHandler until they finish
+func PollingStatus(ids []int64) string {
+	if len(ids) == 0 {
+		return ""
+	}
+
+	strs := make([]string, len(ids))
+	for i, id := range ids {
+		strs[i] = strconv.FormatInt(id, 10)
+	}
+	return fmt.Sprintf(`<div hx-get="/job-status?ids=%s" hx-trigger="every 1s" hx-swap="innerHTML">Processing...</div>`,
+		strings.Join(strs, ","))
+}
+
+// StatusHandler reports on the jobs in ?ids=1,2,3 owned by the current user, answering
+// 286 (htmx stops polling) once they have all finished
+func StatusHandler(w http.ResponseWriter, r *http.Request, q *Queue, st *sessions.CookieStore) {
+	username, err := users.GetCurrentUsername(r, st)
+	if err != nil {
+		http.Error(w, "Unauthorized access", http.StatusUnauthorized)
+		return
+	}
+	admin := users.IsAdmin(r, st)
+
+	var ids []int64
+	for _, s := range strings.Split(r.URL.Query().Get("ids"), ",") {
+		if id, err := strconv.ParseInt(s, 10, 64); err == nil {
+			ids = append(ids, id)
+		}
+	}
+
+	jobs, err := q.Get(ids)
+	if err != nil {
+		log.Printf("error getting job status: %v", err)
+		http.Error(w, "Error getting job status", http.StatusInternalServerError)
+		return
+	}
+
+	visible, finished := 0, 0
+	var failed []string
+	for _, job := range jobs {
+		if job.Owner != username && !admin {
+			continue
+		}
+		visible++
+		switch job.Status {
+		case STATUS_DONE:
+			finished++
+		case STATUS_FAILED:
+			finished++
+			failed = append(failed, template.HTMLEscapeString(job.LastError))
+		}
+	}
+
+	if finished < visible {
+		fmt.Fprintf(w, "Processing... %v of %v done", finished, visible)
+		return
+	}
+
+	w.WriteHeader(286)
+	if len(failed) > 0 {
+		fmt.Fprintf(w, "Processing finished, %v failed:<br>%v", len(failed), strings.Join(failed, "<br>"))
+		return
+	}
+	w.Write([]byte("Processing finished"))
+}
@@ -0,0 +1,185 @@
+package media
+
+import (
+	// internal
+	"blog/internal/storage"
+
+	// golang
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+// match media table in sql db
+type Media struct {
+	Hash     string
+	MimeType string
+	Size     int64
+	Created  time.Time
+}
+
+// Store keeps uploaded files in a storage backend, named by the sha256 of their contents.
+// Files are immutable once written, identical uploads share one file.
+type Store struct {
+	backend storage.Storage
+	db      *sql.DB
+}
+
+const (
+	cacheControl = "public, max-age=31536000, immutable" // files never change for a given hash
+)
+
+func NewStore(backend storage.Storage, db *sql.DB) *Store {
+	return &Store{backend: backend, db: db}
+}
+
+// ValidHash reports whether h looks like a hex encoded sha256 (guards file paths)
+func ValidHash(h string) bool {
+	if len(h) != sha256.Size*2 {
+		return false
+	}
+	for _, c := range h {
+		if !((c >= '0' && c <= '9') || (c >= 'a' && c <= 'f')) {
+			return false
+		}
+	}
+	return true
+}
+
+// files are fanned out by the first two hex chars to keep directories small,
+// the same layout is used by every backend so a media folder can be copied into a bucket as is
+func key(hash string) string {
+	return hash[:2] + "/" + hash
+}
+
+// Put writes the contents of r to the store and returns its hash, if mime_type
+// is empty it is sniffed from the data
+func (s *Store) Put(r io.Reader, mime_type string) (string, error) {
+	// the hash names the file, so it is spooled to a temp file before going to the backend
+	tmp, err := os.CreateTemp("", "upload-*")
+	if err != nil {
+		return "", fmt.Errorf("failed to create temp file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	hasher := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, hasher), r)
+	if err != nil {
+		return "", fmt.Errorf("failed to write temp file: %w", err)
+	}
+
+	if mime_type == "" {
+		head := make([]byte, 512)
+		n, _ := tmp.ReadAt(head, 0)
+		mime_type = http.DetectContentType(head[:n])
+	}
+
+	hash := hex.EncodeToString(hasher.Sum(nil))
+
+	info, err := s.backend.Stat(key(hash))
+	if err != nil || info.Size != size {
+		_, err = tmp.Seek(0, io.SeekStart)
+		if err != nil {
+			return "", fmt.Errorf("failed to rewind temp file: %w", err)
+		}
+		err = s.backend.Put(key(hash), tmp, size, mime_type)
+		if err != nil {
+			return "", fmt.Errorf("failed to store '%v': %w", hash, err)
+		}
+	}
+
+	_, err = s.db.Exec(`
+		INSERT INTO media (hash, mime_type, size)
+		VALUES (?, ?, ?)
+		ON CONFLICT(hash) DO NOTHING`, hash, mime_type, size)
+	if err != nil {
+		return "", fmt.Errorf("failed to record '%v' in database: %w", hash, err)
+	}
+
+	return hash, nil
+}
+
+func (s *Store) Stat(hash string) (Media, error) {
+	var m Media
+	err := s.db.QueryRow("SELECT hash, mime_type, size, created FROM media WHERE hash = ?", hash).
+		Scan(&m.Hash, &m.MimeType, &m.Size, &m.Created)
+	return m, err
+}
+
+// caller must close the returned file
+func (s *Store) Open(hash string) (io.ReadSeekCloser, Media, error) {
+	if !ValidHash(hash) {
+		return nil, Media{}, fmt.Errorf("invalid media hash '%v'", hash)
+	}
+
+	m, err := s.Stat(hash)
+	if err != nil {
+		return nil, Media{}, err
+	}
+
+	f, err := s.backend.Get(key(hash))
+	if err != nil {
+		return nil, Media{}, err
+	}
+	return f, m, nil
+}
+
+// ReadAll returns the full contents of a stored file
+func (s *Store) ReadAll(hash string) ([]byte, error) {
+	f, _, err := s.Open(hash)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+// URL is where clients can fetch a file straight from the backend, empty if it goes through /media/
+func (s *Store) URL(hash string) string {
+	return s.backend.URL(key(hash))
+}
+
+//
+// Serving (/media/{hash})
+//
+
+func ServeMedia(w http.ResponseWriter, r *http.Request, ms *Store) {
+	hash := r.URL.Path[len("/media/"):]
+
+	if !ValidHash(hash) {
+		http.NotFound(w, r)
+		return
+	}
+
+	// backends with a public url serve the file themselves
+	if u := ms.URL(hash); u != "" {
+		w.Header().Set("Cache-Control", cacheControl)
+		http.Redirect(w, r, u, http.StatusFound)
+		return
+	}
+
+	f, m, err := ms.Open(hash)
+	if err != nil {
+		if err != sql.ErrNoRows && err != storage.ErrNotFound {
+			log.Printf("error opening media '%v': %v", hash, err)
+		}
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+
+	// ServeContent answers If-None-Match with 304 using the ETag and handles Range requests
+	w.Header().Set("ETag", `"`+hash+`"`)
+	w.Header().Set("Content-Type", m.MimeType)
+	w.Header().Set("Cache-Control", cacheControl)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+
+	http.ServeContent(w, r, "", m.Created, f)
+}
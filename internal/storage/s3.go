@@ -0,0 +1,293 @@
+package storage
+
+import (
+	// golang
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	s3DefaultRegion = "us-east-1"
+	s3EmptyHash     = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855" // sha256 of no bytes
+	s3Unsigned      = "UNSIGNED-PAYLOAD"                                                 // uploads are streamed, not hashed up front
+)
+
+// S3 keeps objects in a bucket of an S3 compatible service, requests are signed
+// with AWS signature v4 and use path style urls (endpoint/bucket/key) so MinIO
+// and friends work without DNS setup
+type S3 struct {
+	endpoint   *url.URL
+	region     string
+	bucket     string
+	access_key string
+	secret_key string
+	prefix     string
+	public_url string
+	client     *http.Client
+}
+
+func NewS3(cfg Config) (*S3, error) {
+	if cfg.Endpoint == "" || cfg.Bucket == "" || cfg.AccessKey == "" || cfg.SecretKey == "" {
+		return nil, errors.New("s3 storage needs an endpoint, bucket, access key and secret key")
+	}
+
+	endpoint, err := url.Parse(strings.TrimSuffix(cfg.Endpoint, "/"))
+	if err != nil || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid s3 endpoint '%v'", cfg.Endpoint)
+	}
+
+	region := cfg.Region
+	if region == "" {
+		region = s3DefaultRegion
+	}
+
+	return &S3{
+		endpoint:   endpoint,
+		region:     region,
+		bucket:     cfg.Bucket,
+		access_key: cfg.AccessKey,
+		secret_key: cfg.SecretKey,
+		prefix:     strings.Trim(cfg.Prefix, "/"),
+		public_url: strings.TrimSuffix(cfg.PublicURL, "/"),
+		client:     &http.Client{},
+	}, nil
+}
+
+func (s *S3) objectKey(key string) string {
+	if s.prefix == "" {
+		return key
+	}
+	return s.prefix + "/" + key
+}
+
+func (s *S3) Put(key string, r io.Reader, size int64, mime_type string) error {
+	req, err := s.request(http.MethodPut, key, r)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	if size == 0 {
+		req.Body = http.NoBody
+	}
+	if mime_type != "" {
+		req.Header.Set("Content-Type", mime_type)
+	}
+
+	resp, err := s.do(req, s3Unsigned)
+	if err != nil {
+		return fmt.Errorf("failed to put '%v': %w", key, err)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *S3) Get(key string) (io.ReadSeekCloser, error) {
+	info, err := s.Stat(key)
+	if err != nil {
+		return nil, err
+	}
+	return &s3Object{s: s, key: key, size: info.Size}, nil
+}
+
+func (s *S3) Delete(key string) error {
+	req, err := s.request(http.MethodDelete, key, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := s.do(req, s3EmptyHash)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return fmt.Errorf("failed to delete '%v': %w", key, err)
+	}
+	if resp != nil {
+		resp.Body.Close()
+	}
+	return nil
+}
+
+func (s *S3) Stat(key string) (Info, error) {
+	req, err := s.request(http.MethodHead, key, nil)
+	if err != nil {
+		return Info{}, err
+	}
+
+	resp, err := s.do(req, s3EmptyHash)
+	if err != nil {
+		return Info{}, err
+	}
+	resp.Body.Close()
+
+	modified, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return Info{Size: resp.ContentLength, ModTime: modified}, nil
+}
+
+func (s *S3) URL(key string) string {
+	if s.public_url == "" {
+		return ""
+	}
+	return s.public_url + "/" + escapePath(s.objectKey(key))
+}
+
+func (s *S3) request(method string, key string, body io.Reader) (*http.Request, error) {
+	u := *s.endpoint
+	u.Path = s.endpoint.Path + "/" + s.bucket + "/" + s.objectKey(key)
+	u.RawPath = s.endpoint.EscapedPath() + "/" + escapePath(s.bucket+"/"+s.objectKey(key))
+
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build s3 request: %w", err)
+	}
+	return req, nil
+}
+
+// do signs and sends req, a missing object is ErrNotFound and any other non 2xx status is an error
+func (s *S3) do(req *http.Request, payload_hash string) (*http.Response, error) {
+	s.sign(req, payload_hash, time.Now().UTC())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		resp.Body.Close()
+		return nil, ErrNotFound
+	case resp.StatusCode < 200 || resp.StatusCode > 299:
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		resp.Body.Close()
+		return nil, fmt.Errorf("s3 %v %v: %v %s", req.Method, req.URL.Path, resp.Status, msg)
+	}
+	return resp, nil
+}
+
+// sign adds an AWS signature v4 Authorization header to req
+func (s *S3) sign(req *http.Request, payload_hash string, now time.Time) {
+	amz_date := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	req.Header.Set("X-Amz-Date", amz_date)
+	req.Header.Set("X-Amz-Content-Sha256", payload_hash)
+
+	signed_headers := "host;x-amz-content-sha256;x-amz-date"
+	canonical_headers := "host:" + req.URL.Host + "\n" +
+		"x-amz-content-sha256:" + payload_hash + "\n" +
+		"x-amz-date:" + amz_date + "\n"
+
+	canonical_request := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.Query().Encode(),
+		canonical_headers,
+		signed_headers,
+		payload_hash,
+	}, "\n")
+
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	request_hash := sha256.Sum256([]byte(canonical_request))
+	string_to_sign := "AWS4-HMAC-SHA256\n" + amz_date + "\n" + scope + "\n" + hex.EncodeToString(request_hash[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.secret_key), date)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, string_to_sign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%v/%v, SignedHeaders=%v, Signature=%v",
+		s.access_key, scope, signed_headers, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// escapePath percent encodes everything but unreserved characters and slashes, as signature v4 expects
+func escapePath(p string) string {
+	var b strings.Builder
+	for _, c := range []byte(p) {
+		switch {
+		case (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9'),
+			c == '-', c == '_', c == '.', c == '~', c == '/':
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// s3Object reads an object with ranged GETs, the request is only made on the first
+// Read after a Seek so http.ServeContent can find the size and serve ranges cheaply
+type s3Object struct {
+	s    *S3
+	key  string
+	size int64
+	off  int64
+	body io.ReadCloser
+}
+
+func (o *s3Object) Read(p []byte) (int, error) {
+	if o.off >= o.size {
+		return 0, io.EOF
+	}
+
+	if o.body == nil {
+		req, err := o.s.request(http.MethodGet, o.key, nil)
+		if err != nil {
+			return 0, err
+		}
+		req.Header.Set("Range", "bytes="+strconv.FormatInt(o.off, 10)+"-")
+
+		resp, err := o.s.do(req, s3EmptyHash)
+		if err != nil {
+			return 0, err
+		}
+		o.body = resp.Body
+	}
+
+	n, err := o.body.Read(p)
+	o.off += int64(n)
+	return n, err
+}
+
+func (o *s3Object) Seek(offset int64, whence int) (int64, error) {
+	var off int64
+	switch whence {
+	case io.SeekStart:
+		off = offset
+	case io.SeekCurrent:
+		off = o.off + offset
+	case io.SeekEnd:
+		off = o.size + offset
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if off < 0 {
+		return 0, errors.New("negative position")
+	}
+
+	if off != o.off && o.body != nil {
+		o.body.Close()
+		o.body = nil
+	}
+	o.off = off
+	return off, nil
+}
+
+func (o *s3Object) Close() error {
+	if o.body == nil {
+		return nil
+	}
+	return o.body.Close()
+}
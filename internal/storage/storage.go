@@ -0,0 +1,58 @@
+package storage
+
+import (
+	// golang
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// ErrNotFound is returned by Get and Stat when nothing is stored under a key
+var ErrNotFound = errors.New("not found")
+
+// Info describes a stored object
+type Info struct {
+	Size    int64
+	ModTime time.Time
+}
+
+// Storage is where uploaded files live, keys are slash separated paths
+type Storage interface {
+	// Put stores size bytes from r under key, replacing anything already there
+	Put(key string, r io.Reader, size int64, mime_type string) error
+	// Get opens a stored object, seeking is supported so ranges can be served from it
+	Get(key string) (io.ReadSeekCloser, error)
+	Delete(key string) error
+	Stat(key string) (Info, error)
+	// URL is where clients can fetch key directly, empty if it has to be served by us
+	URL(key string) string
+}
+
+// Config selects and sets up a driver, see README for the matching env variables
+type Config struct {
+	Driver string // "local" (default) or "s3"
+
+	// local
+	Root string
+
+	// s3 compatible (AWS, MinIO, R2...)
+	Endpoint  string // e.g. https://s3.us-east-1.amazonaws.com or http://localhost:9000
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	Prefix    string // prepended to every key
+	PublicURL string // optional, objects are linked here instead of proxied through /media/
+}
+
+func New(cfg Config) (Storage, error) {
+	switch cfg.Driver {
+	case "", "local":
+		return NewLocal(cfg.Root)
+	case "s3":
+		return NewS3(cfg)
+	default:
+		return nil, fmt.Errorf("unknown storage driver '%v'", cfg.Driver)
+	}
+}
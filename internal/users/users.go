@@ -3,12 +3,15 @@ package users
 import (
 
 	// golang
+	"crypto/rand"
 	"database/sql"
+	"encoding/hex"
 	"fmt"
 	"html/template"
 	"log"
 	"net/http"
 	"os"
+	"strings"
 	"time"
 
 	// externals
@@ -24,6 +27,7 @@ type User struct {
 	Uploader 		bool  
 	Created 		time.Time
 	LastLogin 		time.Time
+	Subscriptions	map[string]bool // subscription level names, set by GetUsers
 }
 
 func (u User) String() string {
@@ -56,6 +60,9 @@ func getUserFromDB(username string, db *sql.DB) (User, error) {
     return u, nil
 }
 
+// PUBLIC_LEVEL is the access level of pages anyone can read, it has no row in subscription_levels
+const PUBLIC_LEVEL = "public"
+
 func HasSubscriptionLevel(db *sql.DB, username string, level string) (bool, error) {
     query := `
         SELECT EXISTS (
@@ -626,9 +633,188 @@ func GetUsers(db *sql.DB) ([]User, error) {
 			return nil, fmt.Errorf("failed to scan db for accounts: %v", err)
 		}
 
+		u.Subscriptions = map[string]bool{}
 		users = append(users, u)
 		// log.Printf("user: %v", u)
 	}
 
+	sub_rows, err := db.Query(`
+		SELECT u.username, sl.name
+		FROM user_subscriptions us
+		JOIN users u ON u.id = us.user_id
+		JOIN subscription_levels sl ON sl.id = us.subscription_id`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query db for subscriptions: %v", err)
+	}
+	defer sub_rows.Close()
+
+	for sub_rows.Next() {
+		var username, level string
+		err := sub_rows.Scan(&username, &level); if err != nil {
+			return nil, fmt.Errorf("failed to scan db for subscriptions: %v", err)
+		}
+		for i := range users {
+			if users[i].Username == username {
+				users[i].Subscriptions[level] = true
+			}
+		}
+	}
+
 	return users, nil
 }
+
+//
+// Subscription levels
+//
+
+// GetSubscriptionLevels returns the names of all subscription levels, sorted
+func GetSubscriptionLevels(db *sql.DB) ([]string, error) {
+	rows, err := db.Query("SELECT name FROM subscription_levels ORDER BY name")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query db for subscription levels: %v", err)
+	}
+	defer rows.Close()
+
+	levels := []string{}
+	for rows.Next() {
+		var name string
+		err := rows.Scan(&name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan subscription level: %v", err)
+		}
+		levels = append(levels, name)
+	}
+	return levels, rows.Err()
+}
+
+// LevelExists reports whether level can be set on a page, PUBLIC_LEVEL always can
+func LevelExists(db *sql.DB, level string) (bool, error) {
+	if level == PUBLIC_LEVEL {
+		return true, nil
+	}
+
+	var exists bool
+	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM subscription_levels WHERE name = ?)", level).Scan(&exists)
+	return exists, err
+}
+
+func AddSubscriptionLevelHandler(w http.ResponseWriter, r *http.Request, db *sql.DB, st *sessions.CookieStore) {
+	if !IsAdmin(r, st) {
+		log.Printf("non admin attempted to add a subscription level from: %v", r.Host)
+		http.Error(w, "Admins only", http.StatusForbidden)
+		return
+	}
+
+	name := strings.TrimSpace(r.FormValue("name"))
+	if name == "" || name == PUBLIC_LEVEL || len(name) > 32 {
+		w.Write([]byte("Level names must be 1-32 characters and not '" + PUBLIC_LEVEL + "'"))
+		return
+	}
+
+	_, err := db.Exec("INSERT INTO subscription_levels (name) VALUES (?)", name)
+	if err != nil {
+		log.Printf("failed to add subscription level '%v': %v", name, err)
+		w.Write([]byte("Level already exists"))
+		return
+	}
+
+	w.Header().Set("HX-Refresh", "true")
+	w.WriteHeader(http.StatusOK)
+}
+
+// ToggleSubscription grants or revokes a subscription level of a user
+func ToggleSubscription(w http.ResponseWriter, r *http.Request, db *sql.DB, st *sessions.CookieStore) {
+	if !IsAdmin(r, st) {
+		log.Printf("non admin attempted to change a subscription from: %v", r.Host)
+		http.Error(w, "Admins only", http.StatusForbidden)
+		return
+	}
+
+	username := r.FormValue("username")
+	level := r.FormValue("level")
+	if username == "" || level == "" {
+		http.Error(w, "Invalid request: All fields are required", http.StatusBadRequest)
+		return
+	}
+
+	var userID, levelID int64
+	err := db.QueryRow("SELECT id FROM users WHERE username = ?", username).Scan(&userID)
+	if err != nil {
+		log.Printf("invalid request for '%v' to be changed subscription: %v", username, err)
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	err = db.QueryRow("SELECT id FROM subscription_levels WHERE name = ?", level).Scan(&levelID)
+	if err != nil {
+		log.Printf("invalid subscription level '%v': %v", level, err)
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	has, err := HasSubscriptionLevel(db, username, level)
+	if err == nil && has {
+		_, err = db.Exec("DELETE FROM user_subscriptions WHERE user_id = ? AND subscription_id = ?", userID, levelID)
+	} else if err == nil {
+		_, err = db.Exec("INSERT INTO user_subscriptions (user_id, subscription_id) VALUES (?, ?)", userID, levelID)
+	}
+	if err != nil {
+		log.Printf("failed to set '%v' subscription of '%v': %v", level, username, err)
+		http.Error(w, "Failed to update subscription", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(`
+		<div class="alert alert-success">
+			Updated subscription.
+		</div>
+		`))
+}
+
+//
+// Feed tokens
+//
+
+// FeedToken returns the secret that lets username's feed reader fetch /feed without
+// a session, one is made the first time it's asked for
+func FeedToken(db *sql.DB, username string) (string, error) {
+	var token string
+	err := db.QueryRow("SELECT feed_token FROM users WHERE username = ?", username).Scan(&token)
+	if err != nil {
+		return "", fmt.Errorf("failed to get feed token for '%v': %v", username, err)
+	}
+	if token != "" {
+		return token, nil
+	}
+
+	b := make([]byte, 24)
+	_, err = rand.Read(b)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate feed token: %v", err)
+	}
+	token = hex.EncodeToString(b)
+
+	_, err = db.Exec("UPDATE users SET feed_token = ? WHERE username = ? AND feed_token = ''", token, username)
+	if err != nil {
+		return "", fmt.Errorf("failed to set feed token for '%v': %v", username, err)
+	}
+
+	// a concurrent request may have set one first
+	err = db.QueryRow("SELECT feed_token FROM users WHERE username = ?", username).Scan(&token)
+	if err != nil {
+		return "", fmt.Errorf("failed to get feed token for '%v': %v", username, err)
+	}
+	return token, nil
+}
+
+// FeedTokenValid reports whether token belongs to a user
+func FeedTokenValid(db *sql.DB, token string) (bool, error) {
+	if token == "" {
+		return false, nil
+	}
+
+	var exists bool
+	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE feed_token = ?)", token).Scan(&exists)
+	return exists, err
+}
@@ -2,14 +2,10 @@ package main
 
 
 // SECONDARY TODOs
-// TODO: add option to make page unlisted from home page (admins/uploaders only, make an indicator for these posts)
-// TODO: make it so pages set to the future aren't sent to users (unless admin/uploader)
 // TODO: set up like/heart button
 // TODO: add ability to click image to zoom to fit left/right, click again to return to vertical orientation
 // TODO: add hover button/highlight to images like in title bar
 // TODO: add notification when comments happen
-// TODO: check what happens when too large of a tag is used on a page on mobile, there is a chance it might be not
-//		 not shown if its too long. If this is an issue, just add a max tag length
 // TODO: in page nav bar, home button in the middle going back to the home page with that tag still active 
 
 
@@ -27,10 +23,14 @@ package main
 import (
 	// internal
 	"blog/internal/blog"
+	"blog/internal/jobs"
+	"blog/internal/media"
+	"blog/internal/storage"
 	"blog/internal/users"
 	"context"
 	"io"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
@@ -40,6 +40,8 @@ import (
 	"net/http"
 	"os"
 	"fmt"
+	"bytes"
+	"encoding/base64"
 
 	// externals
 	_ "github.com/glebarez/sqlite"
@@ -49,9 +51,137 @@ import (
 const (
 	DatabasePath 	= "database_blog.db"
 	ImagePath    	= "images"
-	DatabaseVersion	= "1.4"
+	MediaPath		= "media"  // uploaded files, content addressed (see internal/media), when MEDIA_STORAGE is local
+	DatabaseVersion	= "1.20"
+	JobWorkers		= 2
 )
 
+// busy_timeout lets the job workers and requests wait on each other's writes,
+// immediate transactions take the write lock up front so they never deadlock upgrading
+const DatabaseOptions = "?_pragma=busy_timeout(5000)&_txlock=immediate"
+
+const image_variants_query = `
+	CREATE TABLE IF NOT EXISTS page_image_variants (
+	page_id INTEGER NOT NULL,
+	source_hash TEXT NOT NULL,
+	kind TEXT NOT NULL,
+	width INTEGER NOT NULL,
+	height INTEGER NOT NULL,
+	media_hash TEXT NOT NULL,
+	mime_type TEXT NOT NULL,
+	FOREIGN KEY (page_id) REFERENCES pages(id)
+		ON DELETE CASCADE
+		ON UPDATE CASCADE,
+	PRIMARY KEY (page_id, source_hash, kind, width, mime_type)
+	);`
+
+const page_images_query = `
+	CREATE TABLE IF NOT EXISTS page_images (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	page_id INTEGER NOT NULL,
+	position INTEGER NOT NULL,
+	media_hash TEXT NOT NULL,
+	caption TEXT NOT NULL DEFAULT '',
+	alt_text TEXT NOT NULL DEFAULT '',
+	animated BOOL DEFAULT 0,
+	focal_x REAL NOT NULL DEFAULT 0.5,
+	focal_y REAL NOT NULL DEFAULT 0,
+	FOREIGN KEY (page_id) REFERENCES pages(id)
+		ON DELETE CASCADE
+		ON UPDATE CASCADE
+	);`
+
+const page_videos_query = `
+	CREATE TABLE IF NOT EXISTS page_videos (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	page_id INTEGER NOT NULL,
+	position INTEGER NOT NULL,
+	media_hash TEXT NOT NULL,
+	mime_type TEXT NOT NULL,
+	poster TEXT NOT NULL DEFAULT '',
+	poster_thumbnail TEXT NOT NULL DEFAULT '',
+	FOREIGN KEY (page_id) REFERENCES pages(id)
+		ON DELETE CASCADE
+		ON UPDATE CASCADE
+	);`
+
+const page_slugs_query = `
+	CREATE TABLE IF NOT EXISTS page_slugs (
+	slug TEXT PRIMARY KEY,
+	page_id INTEGER NOT NULL,
+	created TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	FOREIGN KEY (page_id) REFERENCES pages(id)
+		ON DELETE CASCADE
+		ON UPDATE CASCADE
+	);
+	CREATE INDEX IF NOT EXISTS page_slugs_page ON page_slugs (page_id);`
+
+// other names of a tag, tags typed as an alias are saved as the tag
+const tag_aliases_query = `
+	CREATE TABLE IF NOT EXISTS tag_aliases (
+	alias TEXT PRIMARY KEY,
+	tag_id INTEGER NOT NULL,
+	FOREIGN KEY (tag_id) REFERENCES tags(id)
+		ON DELETE CASCADE
+		ON UPDATE CASCADE
+	);
+	CREATE INDEX IF NOT EXISTS tag_aliases_tag ON tag_aliases (tag_id);`
+
+// a page is in at most one series, at position (1 is the first part)
+const series_query = `
+	CREATE TABLE IF NOT EXISTS series (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	title TEXT NOT NULL UNIQUE,
+	description TEXT NOT NULL DEFAULT '',
+	creator TEXT NOT NULL,
+	created TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE TABLE IF NOT EXISTS series_pages (
+	page_id INTEGER PRIMARY KEY,
+	series_id INTEGER NOT NULL,
+	position INTEGER NOT NULL,
+	FOREIGN KEY (page_id) REFERENCES pages(id)
+		ON DELETE CASCADE
+		ON UPDATE CASCADE,
+	FOREIGN KEY (series_id) REFERENCES series(id)
+		ON DELETE CASCADE
+		ON UPDATE CASCADE
+	);
+	CREATE INDEX IF NOT EXISTS series_pages_series ON series_pages (series_id, position);`
+
+const jobs_query = `
+	CREATE TABLE IF NOT EXISTS jobs (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	kind TEXT NOT NULL,
+	payload TEXT NOT NULL,
+	owner TEXT NOT NULL DEFAULT '',
+	status TEXT NOT NULL DEFAULT 'queued',
+	attempts INTEGER NOT NULL DEFAULT 0,
+	max_attempts INTEGER NOT NULL,
+	last_error TEXT NOT NULL DEFAULT '',
+	run_at INTEGER NOT NULL,
+	created TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	updated TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS jobs_due ON jobs (status, run_at);`
+
+const page_revisions_query = `
+	CREATE TABLE IF NOT EXISTS page_revisions (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	page_id INTEGER NOT NULL,
+	title TEXT NOT NULL,
+	display_title TEXT NOT NULL,
+	content TEXT NOT NULL,
+	tags TEXT NOT NULL DEFAULT '',
+	image TEXT NOT NULL DEFAULT '',
+	editor TEXT NOT NULL,
+	created TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	FOREIGN KEY (page_id) REFERENCES pages(id)
+		ON DELETE CASCADE
+		ON UPDATE CASCADE
+	);
+	CREATE INDEX IF NOT EXISTS page_revisions_page ON page_revisions (page_id);`
+
 func initDatabaseIfNone() bool {
 
 	if _, err := os.Stat(DatabasePath); err == nil {
@@ -93,7 +223,11 @@ func initDatabaseIfNone() bool {
 		unlisted BOOL DEFAULT 0,
 		views INTEGER DEFAULT 0,
 		link_post BOOL DEFAULT 0,
-		url_link TEXT NOT NULL DEFAULT '404'
+		url_link TEXT NOT NULL DEFAULT '404',
+		animated BOOL DEFAULT 0,
+		content_html TEXT NOT NULL DEFAULT '',
+		status TEXT NOT NULL DEFAULT 'published',
+		saved_at TIMESTAMP
     	);`
 
 	_, err = db.Exec(page_query)
@@ -106,8 +240,11 @@ func initDatabaseIfNone() bool {
 		`
 		CREATE TABLE IF NOT EXISTS tags (
 		id INTEGER PRIMARY KEY,
-		name TEXT UNIQUE NOT NULL
+		name TEXT UNIQUE NOT NULL,
+		description TEXT NOT NULL DEFAULT '',
+		parent_id INTEGER REFERENCES tags(id) ON DELETE SET NULL
 		);
+		CREATE INDEX IF NOT EXISTS tags_parent ON tags (parent_id);
 		`
 
 	_, err = db.Exec(tag_query)
@@ -115,6 +252,11 @@ func initDatabaseIfNone() bool {
 		log.Fatalf("Failed to add tag table to DB: %v", err)
 	}
 
+	_, err = db.Exec(tag_aliases_query)
+	if err != nil {
+		log.Fatalf("Failed to add tag aliases table to DB: %v", err)
+	}
+
 	// junction tag table
 	page_tags_query :=
 		`
@@ -166,8 +308,10 @@ func initDatabaseIfNone() bool {
 		admin BOOL NOT NULL DEFAULT 0,
 		uploader BOOL NOT NULL DEFAULT 0,
 		created DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
-		last_login DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
-		);`
+		last_login DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		feed_token TEXT NOT NULL DEFAULT ''
+		);
+		CREATE INDEX IF NOT EXISTS users_feed_token ON users (feed_token);`
 
 	_, err = db.Exec(user_query)
 	if err != nil {
@@ -206,6 +350,63 @@ func initDatabaseIfNone() bool {
 		log.Fatalf("Failed to add subscriptions junction table to DB: %v", err)
 	}
 
+	// uploaded files kept in the storage backend, match Media struct in media.go
+	media_query :=
+		`
+		CREATE TABLE IF NOT EXISTS media (
+		hash TEXT PRIMARY KEY,
+		mime_type TEXT NOT NULL,
+		size INTEGER NOT NULL,
+		created TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+		);`
+
+	_, err = db.Exec(media_query)
+	if err != nil {
+		log.Fatalf("Failed to add media table to DB: %v", err)
+	}
+
+	// resized copies of page images, match ImageVariant struct in images.go
+	_, err = db.Exec(image_variants_query)
+	if err != nil {
+		log.Fatalf("Failed to add page image variants table to DB: %v", err)
+	}
+
+	// page galleries, match PageImage struct in images.go
+	_, err = db.Exec(page_images_query)
+	if err != nil {
+		log.Fatalf("Failed to add page images table to DB: %v", err)
+	}
+
+	// page videos, match PageVideo struct in videos.go
+	_, err = db.Exec(page_videos_query)
+	if err != nil {
+		log.Fatalf("Failed to add page videos table to DB: %v", err)
+	}
+
+	// saved versions of pages, match Revision struct in revisions.go
+	_, err = db.Exec(page_revisions_query)
+	if err != nil {
+		log.Fatalf("Failed to add page revisions table to DB: %v", err)
+	}
+
+	// old titles of renamed pages, for redirects
+	_, err = db.Exec(page_slugs_query)
+	if err != nil {
+		log.Fatalf("Failed to add page slugs table to DB: %v", err)
+	}
+
+	// series of pages in order, match Series struct in series.go
+	_, err = db.Exec(series_query)
+	if err != nil {
+		log.Fatalf("Failed to add series tables to DB: %v", err)
+	}
+
+	// background job queue, match Job struct in internal/jobs
+	_, err = db.Exec(jobs_query)
+	if err != nil {
+		log.Fatalf("Failed to add jobs table to DB: %v", err)
+	}
+
 	version_query := `
     CREATE TABLE IF NOT EXISTS db_version (
         version TEXT NOT NULL
@@ -304,189 +505,1082 @@ func updateDB_1_2_to_1_3(db *sql.DB) error {
     return nil
 }
 
-func getCurrentDBVersion(db *sql.DB) (string, error) {
-    var version string
-    err := db.QueryRow("SELECT version FROM db_version LIMIT 1").Scan(&version)
-    return version, err
-}
-
-// fatal error if database version doesn't match global var
-func check_database_version(db *sql.DB) error {
-    currentVersion, err := getCurrentDBVersion(db)
+// moves the base64 image/thumbnail columns into the media store, the columns then hold hashes.
+// not done in a single transaction since the store writes to the media table as it goes, pages
+// that already hold a hash are skipped so an interrupted migration can simply be rerun
+func updateDB_1_4_to_1_5(db *sql.DB, ms *media.Store) error {
+	log.Printf("Attempting to update databse from 1.4 to 1.5")
+	var found_version string
+    err := db.QueryRow("SELECT version FROM db_version LIMIT 1").Scan(&found_version)
     if err != nil {
         return fmt.Errorf("failed to get database version: %v", err)
     }
 
-    for currentVersion != DatabaseVersion {
-        var updateFn func(*sql.DB) error
-        var nextVersion string
+    if found_version != "1.4" {
+        return fmt.Errorf("wrong database version for migration: expected 1.4, got %v", found_version)
+    }
 
-        switch currentVersion {
-        case "1.1":
-            updateFn = updateDB_1_1_to_1_2
-            nextVersion = "1.2"
-        case "1.2":
-            updateFn = updateDB_1_2_to_1_3
-            nextVersion = "1.3"
-        default:
-            return fmt.Errorf("unsupported database version '%s' (target: '%s')", currentVersion, DatabaseVersion)
-        }
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS media (
+		hash TEXT PRIMARY KEY,
+		mime_type TEXT NOT NULL,
+		size INTEGER NOT NULL,
+		created TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+		);`)
+	if err != nil {
+		return fmt.Errorf("failed to add media table: %v", err)
+	}
 
-        log.Printf("updating database from version '%s' to '%s'", currentVersion, nextVersion)
-        if err := updateFn(db); err != nil {
-            return fmt.Errorf("failed to update database from %s to %s: %v", currentVersion, nextVersion, err)
-        }
+	// collect ids first, the blobs are read one page at a time
+	rows, err := db.Query("SELECT id FROM pages")
+	if err != nil {
+		return fmt.Errorf("failed to get pages: %v", err)
+	}
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan page id: %v", err)
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
 
-        currentVersion, err = getCurrentDBVersion(db)
-        if err != nil {
-            return fmt.Errorf("failed to get database version after update: %v", err)
-        }
+	extract := func(value string) (string, error) {
+		if value == "" || media.ValidHash(value) {
+			return value, nil
+		}
+		data, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return "", fmt.Errorf("failed to decode base64: %v", err)
+		}
+		return ms.Put(bytes.NewReader(data), "")
+	}
+
+	for _, id := range ids {
+		var image, thumbnail string
+		err = db.QueryRow("SELECT image, thumbnail FROM pages WHERE id = ?", id).Scan(&image, &thumbnail)
+		if err != nil {
+			return fmt.Errorf("failed to read images for page %v: %v", id, err)
+		}
+
+		image_hash, err := extract(image)
+		if err != nil {
+			return fmt.Errorf("failed to extract image for page %v: %v", id, err)
+		}
+		thumb_hash, err := extract(thumbnail)
+		if err != nil {
+			return fmt.Errorf("failed to extract thumbnail for page %v: %v", id, err)
+		}
+
+		_, err = db.Exec("UPDATE pages SET image = ?, thumbnail = ? WHERE id = ?", image_hash, thumb_hash, id)
+		if err != nil {
+			return fmt.Errorf("failed to update page %v: %v", id, err)
+		}
+	}
+
+    _, err = db.Exec(`UPDATE db_version SET version = '1.5';`)
+    if err != nil {
+        return fmt.Errorf("failed to update version number: %v", err)
     }
 
-    log.Printf("current database version matches '%s'", DatabaseVersion)
+	// give back the space the blobs used
+	_, err = db.Exec("VACUUM")
+	if err != nil {
+		log.Printf("failed to vacuum database after media migration: %v", err)
+	}
+
+    log.Printf("Successfully migrated database from version 1.4 to 1.5 (%v pages)", len(ids))
     return nil
 }
 
-func main() {
+// adds page_image_variants and generates variants for every existing page image
+func updateDB_1_5_to_1_6(db *sql.DB, ms *media.Store) error {
+	log.Printf("Attempting to update databse from 1.5 to 1.6")
+	var found_version string
+    err := db.QueryRow("SELECT version FROM db_version LIMIT 1").Scan(&found_version)
+    if err != nil {
+        return fmt.Errorf("failed to get database version: %v", err)
+    }
 
-	log_file, err := os.OpenFile("blog.log", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+    if found_version != "1.5" {
+        return fmt.Errorf("wrong database version for migration: expected 1.5, got %v", found_version)
+    }
+
+	_, err = db.Exec(image_variants_query)
 	if err != nil {
-		log.Fatal(err)
+		return fmt.Errorf("failed to add page_image_variants table: %v", err)
 	}
-	defer log_file.Close()
-	mult := io.MultiWriter(os.Stdout, log_file)
-	log.SetOutput(mult)
-
-	init_run := initDatabaseIfNone()
 
-	// accessing database, serving it
-	db, err := sql.Open("sqlite", DatabasePath)
+	err = blog.BackfillImageVariants(db, ms)
 	if err != nil {
-		log.Fatal(err)
+		return fmt.Errorf("failed to generate image variants: %v", err)
 	}
-	defer db.Close()
 
-	check_database_version(db)
+    _, err = db.Exec(`UPDATE db_version SET version = '1.6';`)
+    if err != nil {
+        return fmt.Errorf("failed to update version number: %v", err)
+    }
 
-	// setup session store
-	key := []byte(os.Getenv("SESSION_KEY"))
-	if len(key) == 0 {
-		log.Fatal("SESSION_KEY environment variable must be set")
-	}
-	st := sessions.NewCookieStore(key)
+    log.Printf("Successfully migrated database from version 1.5 to 1.6")
+    return nil
+}
 
-	// Configure session options
-	st.Options = &sessions.Options{
-		Path:     "/",
-		MaxAge:   86400 * 7, // 7 days
-		HttpOnly: true,
-		Secure:   false, // Set to true if using HTTPS, false if not
-		SameSite: http.SameSiteStrictMode,
+// adds page_images, each existing page gets a one image gallery of its current image
+func updateDB_1_6_to_1_7(db *sql.DB) error {
+	log.Printf("Attempting to update databse from 1.6 to 1.7")
+	var found_version string
+    err := db.QueryRow("SELECT version FROM db_version LIMIT 1").Scan(&found_version)
+    if err != nil {
+        return fmt.Errorf("failed to get database version: %v", err)
+    }
+
+    if found_version != "1.6" {
+        return fmt.Errorf("wrong database version for migration: expected 1.6, got %v", found_version)
+    }
+
+    // Start transaction
+    tx, err := db.Begin()
+    if err != nil {
+        return fmt.Errorf("failed to begin transaction: %v", err)
+    }
+    defer tx.Rollback() // Will rollback if we don't commit
+
+	// the table as of 1.7, later columns are added by their own migrations
+	_, err = tx.Exec(`
+		CREATE TABLE IF NOT EXISTS page_images (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		page_id INTEGER NOT NULL,
+		position INTEGER NOT NULL,
+		media_hash TEXT NOT NULL,
+		caption TEXT NOT NULL DEFAULT '',
+		alt_text TEXT NOT NULL DEFAULT '',
+		FOREIGN KEY (page_id) REFERENCES pages(id)
+			ON DELETE CASCADE
+			ON UPDATE CASCADE
+		);`)
+	if err != nil {
+		return fmt.Errorf("failed to add page_images table: %v", err)
 	}
-	// TODO: update to domain name (as const)
-	// st.Options.Domain = "domain.com"
 
-	if init_run {
-		users.InitAdmin(db)
+	_, err = tx.Exec(`
+		INSERT INTO page_images (page_id, position, media_hash, alt_text)
+		SELECT id, 0, image, display_title FROM pages WHERE image != ''`)
+	if err != nil {
+		return fmt.Errorf("failed to copy page images: %v", err)
 	}
 
-	// server loop
-	log.Println("Starting web server")
+    _, err = tx.Exec(`UPDATE db_version SET version = '1.7';`)
+    if err != nil {
+        return fmt.Errorf("failed to update version number: %v", err)
+    }
 
-	mux := http.NewServeMux()
+    err = tx.Commit()
+    if err != nil {
+        return fmt.Errorf("failed to commit changes: %v", err)
+    }
 
-	//
-	// Pages
-	//
-	// TODO: add root / request that forward to the most recent page
-	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		blog.HomePage(w, r, db, st)
-	})
-	mux.HandleFunc("/page/", func(w http.ResponseWriter, r *http.Request) {
-		blog.PageRequest(w, r, db, st)
-	})
-	mux.HandleFunc("/upload", func(w http.ResponseWriter, r *http.Request) {
-		blog.UploadPage(w, r, st)
-	})
-	mux.HandleFunc("/sign-up", func(w http.ResponseWriter, r *http.Request) {
-		blog.RenderTemplate(w, r, "Sign Up", nil, st)
-	})
-	mux.HandleFunc("/user-management", func(w http.ResponseWriter, r *http.Request) {
-		blog.AccountsPageHandler(w, r, db, st)
-	})
-	mux.HandleFunc("/test", func(w http.ResponseWriter, r *http.Request) {
-		blog.TestPage(w, r, db, st)
-	})
-	mux.HandleFunc("/uploader/", func(w http.ResponseWriter, r *http.Request) {
-		blog.UploaderPage(w, r, st)
-	})
-	mux.HandleFunc("/login", func(w http.ResponseWriter, r *http.Request) {
-		blog.RenderTemplate(w, r, "Log In", nil, st)
-	})
-	mux.HandleFunc("/edit-page/", func (w http.ResponseWriter, r *http.Request) {
-		blog.EditPage(w, r, db, st)
-	})
+    log.Printf("Successfully migrated database from version 1.6 to 1.7")
+    return nil
+}
 
-	//
-	// Functions (htmx requests etc)
-	//
-	mux.HandleFunc("/upload-page", func(w http.ResponseWriter, r *http.Request) {
-		blog.UploadHandler(w, r, db, st)
-	})
-	mux.HandleFunc("/delete", func(w http.ResponseWriter, r *http.Request) {
-		blog.DeletePageHandler(w, r, db, st)
-	})
-	mux.HandleFunc("/modify-page", func(w http.ResponseWriter, r *http.Request) {
-		blog.EditPageHandler(w, r, db, st)
-	})
-	mux.HandleFunc("/request-account", func(w http.ResponseWriter, r *http.Request) {
-		users.NewUserAccountRequestHandler(w, r, db, st)
-	})
-	mux.HandleFunc("/request-login", func(w http.ResponseWriter, r *http.Request) {
-		users.RequestLogin(w, r, db, st)
-	})
-	mux.HandleFunc("/request-logout", func(w http.ResponseWriter, r *http.Request) {
-		users.RequestLogout(w, r, db, st)
-	})
-	mux.HandleFunc("/request-authenticate/", func(w http.ResponseWriter, r *http.Request) {
-		users.RequestAuthentication(w, r, st)
-	})
-	mux.HandleFunc("/delete-user", func(w http.ResponseWriter, r *http.Request) {
-		users.DeleteUserHandler(w, r, db, st)
-	})
-	mux.HandleFunc("/toggle-admin", func(w http.ResponseWriter, r *http.Request) {
-		users.ToggleAdmin(w, r, db, st)
-	})
-	mux.HandleFunc("/toggle-uploader", func(w http.ResponseWriter, r *http.Request) {
-		users.ToggleUploader(w, r, db, st)
-	})
-	mux.HandleFunc("/add-comment", func(w http.ResponseWriter, r *http.Request) {
-		blog.AddCommentHandler(w, r, db, st)
-	})
+// adds the animated flags to pages and page_images, and flags existing animations
+func updateDB_1_7_to_1_8(db *sql.DB, ms *media.Store) error {
+	log.Printf("Attempting to update databse from 1.7 to 1.8")
+	var found_version string
+    err := db.QueryRow("SELECT version FROM db_version LIMIT 1").Scan(&found_version)
+    if err != nil {
+        return fmt.Errorf("failed to get database version: %v", err)
+    }
 
-	// serve static files (deps/images)
-	fileServer := http.FileServer(http.Dir("."))
-	mux.Handle("/dep/", fileServer)
-	mux.Handle("/images/", fileServer)
-	mux.Handle("/games/", fileServer)
-	mux.HandleFunc("/favicon.ico", func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusNoContent)
-	})
+    if found_version != "1.7" {
+        return fmt.Errorf("wrong database version for migration: expected 1.7, got %v", found_version)
+    }
 
-	srv := &http.Server{
-		Addr:    ":8080",
-		Handler: mux,
+	// files are read before the transaction, it only has to hold the writes
+	animated, err := blog.AnimatedImages(db, ms)
+	if err != nil {
+		return fmt.Errorf("failed to find animated images: %v", err)
 	}
 
-	go func() {
-		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Fatalf("listen: %s\n", err)
-		}
-	}()
+    // Start transaction
+    tx, err := db.Begin()
+    if err != nil {
+        return fmt.Errorf("failed to begin transaction: %v", err)
+    }
+    defer tx.Rollback() // Will rollback if we don't commit
 
-	quit := make(chan os.Signal, 1)
-	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
-	<-quit
+	_, err = tx.Exec(`ALTER TABLE pages ADD COLUMN animated BOOL DEFAULT 0;`)
+	if err != nil {
+		return fmt.Errorf("failed to add pages.animated column: %v", err)
+	}
+
+	_, err = tx.Exec(`ALTER TABLE page_images ADD COLUMN animated BOOL DEFAULT 0;`)
+	if err != nil {
+		return fmt.Errorf("failed to add page_images.animated column: %v", err)
+	}
+
+	err = blog.BackfillAnimated(tx, animated)
+	if err != nil {
+		return fmt.Errorf("failed to flag animated images: %v", err)
+	}
+
+    _, err = tx.Exec(`UPDATE db_version SET version = '1.8';`)
+    if err != nil {
+        return fmt.Errorf("failed to update version number: %v", err)
+    }
+
+    err = tx.Commit()
+    if err != nil {
+        return fmt.Errorf("failed to commit changes: %v", err)
+    }
+
+    log.Printf("Successfully migrated database from version 1.7 to 1.8")
+    return nil
+}
+
+// adds page_videos
+func updateDB_1_8_to_1_9(db *sql.DB) error {
+	log.Printf("Attempting to update databse from 1.8 to 1.9")
+	var found_version string
+    err := db.QueryRow("SELECT version FROM db_version LIMIT 1").Scan(&found_version)
+    if err != nil {
+        return fmt.Errorf("failed to get database version: %v", err)
+    }
+
+    if found_version != "1.8" {
+        return fmt.Errorf("wrong database version for migration: expected 1.8, got %v", found_version)
+    }
+
+    // Start transaction
+    tx, err := db.Begin()
+    if err != nil {
+        return fmt.Errorf("failed to begin transaction: %v", err)
+    }
+    defer tx.Rollback() // Will rollback if we don't commit
+
+	_, err = tx.Exec(page_videos_query)
+	if err != nil {
+		return fmt.Errorf("failed to add page_videos table: %v", err)
+	}
+
+    _, err = tx.Exec(`UPDATE db_version SET version = '1.9';`)
+    if err != nil {
+        return fmt.Errorf("failed to update version number: %v", err)
+    }
+
+    err = tx.Commit()
+    if err != nil {
+        return fmt.Errorf("failed to commit changes: %v", err)
+    }
+
+    log.Printf("Successfully migrated database from version 1.8 to 1.9")
+    return nil
+}
+
+// adds thumbnail focal points to page_images, existing images keep the old top crop
+func updateDB_1_9_to_1_10(db *sql.DB) error {
+	log.Printf("Attempting to update databse from 1.9 to 1.10")
+	var found_version string
+    err := db.QueryRow("SELECT version FROM db_version LIMIT 1").Scan(&found_version)
+    if err != nil {
+        return fmt.Errorf("failed to get database version: %v", err)
+    }
+
+    if found_version != "1.9" {
+        return fmt.Errorf("wrong database version for migration: expected 1.9, got %v", found_version)
+    }
+
+    // Start transaction
+    tx, err := db.Begin()
+    if err != nil {
+        return fmt.Errorf("failed to begin transaction: %v", err)
+    }
+    defer tx.Rollback() // Will rollback if we don't commit
+
+	_, err = tx.Exec(`ALTER TABLE page_images ADD COLUMN focal_x REAL NOT NULL DEFAULT 0.5;`)
+	if err != nil {
+		return fmt.Errorf("failed to add focal_x column: %v", err)
+	}
+
+	_, err = tx.Exec(`ALTER TABLE page_images ADD COLUMN focal_y REAL NOT NULL DEFAULT 0;`)
+	if err != nil {
+		return fmt.Errorf("failed to add focal_y column: %v", err)
+	}
+
+    _, err = tx.Exec(`UPDATE db_version SET version = '1.10';`)
+    if err != nil {
+        return fmt.Errorf("failed to update version number: %v", err)
+    }
+
+    err = tx.Commit()
+    if err != nil {
+        return fmt.Errorf("failed to commit changes: %v", err)
+    }
+
+    log.Printf("Successfully migrated database from version 1.9 to 1.10")
+    return nil
+}
+
+// adds the background job queue
+func updateDB_1_10_to_1_11(db *sql.DB) error {
+	log.Printf("Attempting to update databse from 1.10 to 1.11")
+	var found_version string
+    err := db.QueryRow("SELECT version FROM db_version LIMIT 1").Scan(&found_version)
+    if err != nil {
+        return fmt.Errorf("failed to get database version: %v", err)
+    }
+
+    if found_version != "1.10" {
+        return fmt.Errorf("wrong database version for migration: expected 1.10, got %v", found_version)
+    }
+
+    // Start transaction
+    tx, err := db.Begin()
+    if err != nil {
+        return fmt.Errorf("failed to begin transaction: %v", err)
+    }
+    defer tx.Rollback() // Will rollback if we don't commit
+
+	_, err = tx.Exec(jobs_query)
+	if err != nil {
+		return fmt.Errorf("failed to add jobs table: %v", err)
+	}
+
+    _, err = tx.Exec(`UPDATE db_version SET version = '1.11';`)
+    if err != nil {
+        return fmt.Errorf("failed to update version number: %v", err)
+    }
+
+    err = tx.Commit()
+    if err != nil {
+        return fmt.Errorf("failed to commit changes: %v", err)
+    }
+
+    log.Printf("Successfully migrated database from version 1.10 to 1.11")
+    return nil
+}
+
+// adds a cache of the rendered markdown content to pages, filled in as pages are viewed
+func updateDB_1_11_to_1_12(db *sql.DB) error {
+	log.Printf("Attempting to update databse from 1.11 to 1.12")
+	var found_version string
+    err := db.QueryRow("SELECT version FROM db_version LIMIT 1").Scan(&found_version)
+    if err != nil {
+        return fmt.Errorf("failed to get database version: %v", err)
+    }
+
+    if found_version != "1.11" {
+        return fmt.Errorf("wrong database version for migration: expected 1.11, got %v", found_version)
+    }
+
+    // Start transaction
+    tx, err := db.Begin()
+    if err != nil {
+        return fmt.Errorf("failed to begin transaction: %v", err)
+    }
+    defer tx.Rollback() // Will rollback if we don't commit
+
+	_, err = tx.Exec(`ALTER TABLE pages ADD COLUMN content_html TEXT NOT NULL DEFAULT '';`)
+	if err != nil {
+		return fmt.Errorf("failed to add content_html column: %v", err)
+	}
+
+    _, err = tx.Exec(`UPDATE db_version SET version = '1.12';`)
+    if err != nil {
+        return fmt.Errorf("failed to update version number: %v", err)
+    }
+
+    err = tx.Commit()
+    if err != nil {
+        return fmt.Errorf("failed to commit changes: %v", err)
+    }
+
+    log.Printf("Successfully migrated database from version 1.11 to 1.12")
+    return nil
+}
+
+// adds page_revisions, existing pages start with their current state as the first revision
+func updateDB_1_12_to_1_13(db *sql.DB) error {
+	log.Printf("Attempting to update databse from 1.12 to 1.13")
+	var found_version string
+    err := db.QueryRow("SELECT version FROM db_version LIMIT 1").Scan(&found_version)
+    if err != nil {
+        return fmt.Errorf("failed to get database version: %v", err)
+    }
+
+    if found_version != "1.12" {
+        return fmt.Errorf("wrong database version for migration: expected 1.12, got %v", found_version)
+    }
+
+    // Start transaction
+    tx, err := db.Begin()
+    if err != nil {
+        return fmt.Errorf("failed to begin transaction: %v", err)
+    }
+    defer tx.Rollback() // Will rollback if we don't commit
+
+	_, err = tx.Exec(page_revisions_query)
+	if err != nil {
+		return fmt.Errorf("failed to add page_revisions table: %v", err)
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO page_revisions (page_id, title, display_title, content, tags, image, editor)
+		SELECT id, title, display_title, content,
+			COALESCE((
+				SELECT group_concat(name, ' ') FROM (
+					SELECT t.name FROM page_tags pt JOIN tags t ON t.id = pt.tag_id
+					WHERE pt.page_id = pages.id ORDER BY t.name)), ''),
+			image, uploader
+		FROM pages ORDER BY id`)
+	if err != nil {
+		return fmt.Errorf("failed to save first revisions: %v", err)
+	}
+
+    _, err = tx.Exec(`UPDATE db_version SET version = '1.13';`)
+    if err != nil {
+        return fmt.Errorf("failed to update version number: %v", err)
+    }
+
+    err = tx.Commit()
+    if err != nil {
+        return fmt.Errorf("failed to commit changes: %v", err)
+    }
+
+    log.Printf("Successfully migrated database from version 1.12 to 1.13")
+    return nil
+}
+
+func updateDB_1_13_to_1_14(db *sql.DB) error {
+	log.Printf("Attempting to update databse from 1.13 to 1.14")
+	var found_version string
+    err := db.QueryRow("SELECT version FROM db_version LIMIT 1").Scan(&found_version)
+    if err != nil {
+        return fmt.Errorf("failed to get database version: %v", err)
+    }
+
+    if found_version != "1.13" {
+        return fmt.Errorf("wrong database version for migration: expected 1.13, got %v", found_version)
+    }
+
+    // Start transaction
+    tx, err := db.Begin()
+    if err != nil {
+        return fmt.Errorf("failed to begin transaction: %v", err)
+    }
+    defer tx.Rollback() // Will rollback if we don't commit
+
+	// existing pages are all published
+	_, err = tx.Exec(`ALTER TABLE pages ADD COLUMN status TEXT NOT NULL DEFAULT 'published';`)
+	if err != nil {
+		return fmt.Errorf("failed to add status column: %v", err)
+	}
+
+	_, err = tx.Exec(`ALTER TABLE pages ADD COLUMN saved_at TIMESTAMP;`)
+	if err != nil {
+		return fmt.Errorf("failed to add saved_at column: %v", err)
+	}
+
+    _, err = tx.Exec(`UPDATE db_version SET version = '1.14';`)
+    if err != nil {
+        return fmt.Errorf("failed to update version number: %v", err)
+    }
+
+    err = tx.Commit()
+    if err != nil {
+        return fmt.Errorf("failed to commit changes: %v", err)
+    }
+
+    log.Printf("Successfully migrated database from version 1.13 to 1.14")
+    return nil
+}
+
+func updateDB_1_14_to_1_15(db *sql.DB) error {
+	log.Printf("Attempting to update databse from 1.14 to 1.15")
+	var found_version string
+    err := db.QueryRow("SELECT version FROM db_version LIMIT 1").Scan(&found_version)
+    if err != nil {
+        return fmt.Errorf("failed to get database version: %v", err)
+    }
+
+    if found_version != "1.14" {
+        return fmt.Errorf("wrong database version for migration: expected 1.14, got %v", found_version)
+    }
+
+    // Start transaction
+    tx, err := db.Begin()
+    if err != nil {
+        return fmt.Errorf("failed to begin transaction: %v", err)
+    }
+    defer tx.Rollback() // Will rollback if we don't commit
+
+	_, err = tx.Exec(page_slugs_query)
+	if err != nil {
+		return fmt.Errorf("failed to add page_slugs table: %v", err)
+	}
+
+    _, err = tx.Exec(`UPDATE db_version SET version = '1.15';`)
+    if err != nil {
+        return fmt.Errorf("failed to update version number: %v", err)
+    }
+
+    err = tx.Commit()
+    if err != nil {
+        return fmt.Errorf("failed to commit changes: %v", err)
+    }
+
+    log.Printf("Successfully migrated database from version 1.14 to 1.15")
+    return nil
+}
+
+func updateDB_1_15_to_1_16(db *sql.DB) error {
+	log.Printf("Attempting to update databse from 1.15 to 1.16")
+	var found_version string
+    err := db.QueryRow("SELECT version FROM db_version LIMIT 1").Scan(&found_version)
+    if err != nil {
+        return fmt.Errorf("failed to get database version: %v", err)
+    }
+
+    if found_version != "1.15" {
+        return fmt.Errorf("wrong database version for migration: expected 1.15, got %v", found_version)
+    }
+
+    // Start transaction
+    tx, err := db.Begin()
+    if err != nil {
+        return fmt.Errorf("failed to begin transaction: %v", err)
+    }
+    defer tx.Rollback() // Will rollback if we don't commit
+
+	_, err = tx.Exec(series_query)
+	if err != nil {
+		return fmt.Errorf("failed to add series tables: %v", err)
+	}
+
+    _, err = tx.Exec(`UPDATE db_version SET version = '1.16';`)
+    if err != nil {
+        return fmt.Errorf("failed to update version number: %v", err)
+    }
+
+    err = tx.Commit()
+    if err != nil {
+        return fmt.Errorf("failed to commit changes: %v", err)
+    }
+
+    log.Printf("Successfully migrated database from version 1.15 to 1.16")
+    return nil
+}
+
+func updateDB_1_16_to_1_17(db *sql.DB) error {
+	log.Printf("Attempting to update databse from 1.16 to 1.17")
+	var found_version string
+    err := db.QueryRow("SELECT version FROM db_version LIMIT 1").Scan(&found_version)
+    if err != nil {
+        return fmt.Errorf("failed to get database version: %v", err)
+    }
+
+    if found_version != "1.16" {
+        return fmt.Errorf("wrong database version for migration: expected 1.16, got %v", found_version)
+    }
+
+    // Start transaction
+    tx, err := db.Begin()
+    if err != nil {
+        return fmt.Errorf("failed to begin transaction: %v", err)
+    }
+    defer tx.Rollback() // Will rollback if we don't commit
+
+	_, err = tx.Exec(`ALTER TABLE tags ADD COLUMN description TEXT NOT NULL DEFAULT ''`)
+	if err != nil {
+		return fmt.Errorf("failed to add description column to tags: %v", err)
+	}
+
+	_, err = tx.Exec(tag_aliases_query)
+	if err != nil {
+		return fmt.Errorf("failed to add tag_aliases table: %v", err)
+	}
+
+    _, err = tx.Exec(`UPDATE db_version SET version = '1.17';`)
+    if err != nil {
+        return fmt.Errorf("failed to update version number: %v", err)
+    }
+
+    err = tx.Commit()
+    if err != nil {
+        return fmt.Errorf("failed to commit changes: %v", err)
+    }
+
+    log.Printf("Successfully migrated database from version 1.16 to 1.17")
+    return nil
+}
+
+// normalizes existing tags, case and unicode variants of a tag are merged
+func updateDB_1_17_to_1_18(db *sql.DB) error {
+	log.Printf("Attempting to update databse from 1.17 to 1.18")
+	var found_version string
+    err := db.QueryRow("SELECT version FROM db_version LIMIT 1").Scan(&found_version)
+    if err != nil {
+        return fmt.Errorf("failed to get database version: %v", err)
+    }
+
+    if found_version != "1.17" {
+        return fmt.Errorf("wrong database version for migration: expected 1.17, got %v", found_version)
+    }
+
+	err = blog.NormalizeExistingTags(db)
+	if err != nil {
+		return fmt.Errorf("failed to normalize tags: %v", err)
+	}
+
+    _, err = db.Exec(`UPDATE db_version SET version = '1.18';`)
+    if err != nil {
+        return fmt.Errorf("failed to update version number: %v", err)
+    }
+
+    log.Printf("Successfully migrated database from version 1.17 to 1.18")
+    return nil
+}
+
+// adds parent tags
+func updateDB_1_18_to_1_19(db *sql.DB) error {
+	log.Printf("Attempting to update databse from 1.18 to 1.19")
+	var found_version string
+    err := db.QueryRow("SELECT version FROM db_version LIMIT 1").Scan(&found_version)
+    if err != nil {
+        return fmt.Errorf("failed to get database version: %v", err)
+    }
+
+    if found_version != "1.18" {
+        return fmt.Errorf("wrong database version for migration: expected 1.18, got %v", found_version)
+    }
+
+    // Start transaction
+    tx, err := db.Begin()
+    if err != nil {
+        return fmt.Errorf("failed to begin transaction: %v", err)
+    }
+    defer tx.Rollback() // Will rollback if we don't commit
+
+	_, err = tx.Exec(`ALTER TABLE tags ADD COLUMN parent_id INTEGER REFERENCES tags(id) ON DELETE SET NULL`)
+	if err != nil {
+		return fmt.Errorf("failed to add parent_id column to tags: %v", err)
+	}
+
+	_, err = tx.Exec(`CREATE INDEX IF NOT EXISTS tags_parent ON tags (parent_id)`)
+	if err != nil {
+		return fmt.Errorf("failed to add tags parent index: %v", err)
+	}
+
+    _, err = tx.Exec(`UPDATE db_version SET version = '1.19';`)
+    if err != nil {
+        return fmt.Errorf("failed to update version number: %v", err)
+    }
+
+    err = tx.Commit()
+    if err != nil {
+        return fmt.Errorf("failed to commit changes: %v", err)
+    }
+
+    log.Printf("Successfully migrated database from version 1.18 to 1.19")
+    return nil
+}
+
+// adds users.feed_token, the per user secret in feed urls
+func updateDB_1_19_to_1_20(db *sql.DB) error {
+	log.Printf("Attempting to update databse from 1.19 to 1.20")
+	var found_version string
+    err := db.QueryRow("SELECT version FROM db_version LIMIT 1").Scan(&found_version)
+    if err != nil {
+        return fmt.Errorf("failed to get database version: %v", err)
+    }
+
+    if found_version != "1.19" {
+        return fmt.Errorf("wrong database version for migration: expected 1.19, got %v", found_version)
+    }
+
+    // Start transaction
+    tx, err := db.Begin()
+    if err != nil {
+        return fmt.Errorf("failed to begin transaction: %v", err)
+    }
+    defer tx.Rollback() // Will rollback if we don't commit
+
+	_, err = tx.Exec(`ALTER TABLE users ADD COLUMN feed_token TEXT NOT NULL DEFAULT ''`)
+	if err != nil {
+		return fmt.Errorf("failed to add feed_token column to users: %v", err)
+	}
+
+	_, err = tx.Exec(`CREATE INDEX IF NOT EXISTS users_feed_token ON users (feed_token)`)
+	if err != nil {
+		return fmt.Errorf("failed to add users feed token index: %v", err)
+	}
+
+    _, err = tx.Exec(`UPDATE db_version SET version = '1.20';`)
+    if err != nil {
+        return fmt.Errorf("failed to update version number: %v", err)
+    }
+
+    err = tx.Commit()
+    if err != nil {
+        return fmt.Errorf("failed to commit changes: %v", err)
+    }
+
+    log.Printf("Successfully migrated database from version 1.19 to 1.20")
+    return nil
+}
+
+func getCurrentDBVersion(db *sql.DB) (string, error) {
+    var version string
+    err := db.QueryRow("SELECT version FROM db_version LIMIT 1").Scan(&version)
+    return version, err
+}
+
+// fatal error if database version doesn't match global var
+func check_database_version(db *sql.DB, ms *media.Store) error {
+    currentVersion, err := getCurrentDBVersion(db)
+    if err != nil {
+        return fmt.Errorf("failed to get database version: %v", err)
+    }
+
+    for currentVersion != DatabaseVersion {
+        var updateFn func(*sql.DB) error
+        var nextVersion string
+
+        switch currentVersion {
+        case "1.1":
+            updateFn = updateDB_1_1_to_1_2
+            nextVersion = "1.2"
+        case "1.2":
+            updateFn = updateDB_1_2_to_1_3
+            nextVersion = "1.3"
+        case "1.4":
+            updateFn = func(db *sql.DB) error { return updateDB_1_4_to_1_5(db, ms) }
+            nextVersion = "1.5"
+        case "1.5":
+            updateFn = func(db *sql.DB) error { return updateDB_1_5_to_1_6(db, ms) }
+            nextVersion = "1.6"
+        case "1.6":
+            updateFn = updateDB_1_6_to_1_7
+            nextVersion = "1.7"
+        case "1.7":
+            updateFn = func(db *sql.DB) error { return updateDB_1_7_to_1_8(db, ms) }
+            nextVersion = "1.8"
+        case "1.8":
+            updateFn = updateDB_1_8_to_1_9
+            nextVersion = "1.9"
+        case "1.9":
+            updateFn = updateDB_1_9_to_1_10
+            nextVersion = "1.10"
+        case "1.10":
+            updateFn = updateDB_1_10_to_1_11
+            nextVersion = "1.11"
+        case "1.11":
+            updateFn = updateDB_1_11_to_1_12
+            nextVersion = "1.12"
+        case "1.12":
+            updateFn = updateDB_1_12_to_1_13
+            nextVersion = "1.13"
+        case "1.13":
+            updateFn = updateDB_1_13_to_1_14
+            nextVersion = "1.14"
+        case "1.14":
+            updateFn = updateDB_1_14_to_1_15
+            nextVersion = "1.15"
+        case "1.15":
+            updateFn = updateDB_1_15_to_1_16
+            nextVersion = "1.16"
+        case "1.16":
+            updateFn = updateDB_1_16_to_1_17
+            nextVersion = "1.17"
+        case "1.17":
+            updateFn = updateDB_1_17_to_1_18
+            nextVersion = "1.18"
+        case "1.18":
+            updateFn = updateDB_1_18_to_1_19
+            nextVersion = "1.19"
+        case "1.19":
+            updateFn = updateDB_1_19_to_1_20
+            nextVersion = "1.20"
+        default:
+            return fmt.Errorf("unsupported database version '%s' (target: '%s')", currentVersion, DatabaseVersion)
+        }
+
+        log.Printf("updating database from version '%s' to '%s'", currentVersion, nextVersion)
+        if err := updateFn(db); err != nil {
+            return fmt.Errorf("failed to update database from %s to %s: %v", currentVersion, nextVersion, err)
+        }
+
+        currentVersion, err = getCurrentDBVersion(db)
+        if err != nil {
+            return fmt.Errorf("failed to get database version after update: %v", err)
+        }
+    }
+
+    log.Printf("current database version matches '%s'", DatabaseVersion)
+    return nil
+}
+
+func main() {
+
+	log_file, err := os.OpenFile("blog.log", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer log_file.Close()
+	mult := io.MultiWriter(os.Stdout, log_file)
+	log.SetOutput(mult)
+
+	init_run := initDatabaseIfNone()
+
+	// accessing database, serving it
+	db, err := sql.Open("sqlite", DatabasePath+DatabaseOptions)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	// where uploads are kept, local disk unless MEDIA_STORAGE=s3
+	backend, err := storage.New(storage.Config{
+		Driver:    os.Getenv("MEDIA_STORAGE"),
+		Root:      MediaPath,
+		Endpoint:  os.Getenv("S3_ENDPOINT"),
+		Region:    os.Getenv("S3_REGION"),
+		Bucket:    os.Getenv("S3_BUCKET"),
+		AccessKey: os.Getenv("S3_ACCESS_KEY"),
+		SecretKey: os.Getenv("S3_SECRET_KEY"),
+		Prefix:    os.Getenv("S3_PREFIX"),
+		PublicURL: os.Getenv("S3_PUBLIC_URL"),
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	ms := media.NewStore(backend, db)
+
+	err = check_database_version(db, ms)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// setup session store
+	key := []byte(os.Getenv("SESSION_KEY"))
+	if len(key) == 0 {
+		log.Fatal("SESSION_KEY environment variable must be set")
+	}
+	st := sessions.NewCookieStore(key)
+
+	// Configure session options
+	st.Options = &sessions.Options{
+		Path:     "/",
+		MaxAge:   86400 * 7, // 7 days
+		HttpOnly: true,
+		Secure:   false, // Set to true if using HTTPS, false if not
+		SameSite: http.SameSiteStrictMode,
+	}
+	// TODO: update to domain name (as const)
+	// st.Options.Domain = "domain.com"
+
+	if init_run {
+		users.InitAdmin(db)
+	}
+
+	// EXIF fields to keep on uploaded images (comma separated, e.g. "Copyright,Artist")
+	for _, field := range strings.Split(os.Getenv("EXIF_WHITELIST"), ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			blog.ExifWhitelist = append(blog.ExifWhitelist, field)
+		}
+	}
+
+	// background jobs (thumbnails, image variants)
+	q := jobs.NewQueue(db, JobWorkers)
+	blog.RegisterJobs(q, db, ms)
+	err = q.Start()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// server loop
+	log.Println("Starting web server")
+
+	mux := http.NewServeMux()
+
+	//
+	// Pages
+	//
+	// TODO: add root / request that forward to the most recent page
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		blog.HomePage(w, r, db, st)
+	})
+	mux.HandleFunc("/p/", func(w http.ResponseWriter, r *http.Request) {
+		blog.PageRequest(w, r, db, st)
+	})
+	mux.HandleFunc("/page/", func(w http.ResponseWriter, r *http.Request) {
+		blog.PageSlugRedirect(w, r, db, st)
+	})
+	mux.HandleFunc("/upload", func(w http.ResponseWriter, r *http.Request) {
+		blog.UploadPage(w, r, db, st)
+	})
+	mux.HandleFunc("/sign-up", func(w http.ResponseWriter, r *http.Request) {
+		blog.RenderTemplate(w, r, "Sign Up", nil, st)
+	})
+	mux.HandleFunc("/user-management", func(w http.ResponseWriter, r *http.Request) {
+		blog.AccountsPageHandler(w, r, db, st)
+	})
+	mux.HandleFunc("/tag-management", func(w http.ResponseWriter, r *http.Request) {
+		blog.TagManagementPage(w, r, db, st)
+	})
+	mux.HandleFunc("/test", func(w http.ResponseWriter, r *http.Request) {
+		blog.TestPage(w, r, db, st)
+	})
+	mux.HandleFunc("/uploader/", func(w http.ResponseWriter, r *http.Request) {
+		blog.UploaderPage(w, r, st)
+	})
+	mux.HandleFunc("/login", func(w http.ResponseWriter, r *http.Request) {
+		blog.RenderTemplate(w, r, "Log In", nil, st)
+	})
+	mux.HandleFunc("/edit-page/", func (w http.ResponseWriter, r *http.Request) {
+		blog.EditPage(w, r, db, st)
+	})
+	mux.HandleFunc("/page-history/", func(w http.ResponseWriter, r *http.Request) {
+		blog.PageHistory(w, r, db, st)
+	})
+	mux.HandleFunc("/series", func(w http.ResponseWriter, r *http.Request) {
+		blog.SeriesIndexPage(w, r, db, st)
+	})
+	mux.HandleFunc("/series/", func(w http.ResponseWriter, r *http.Request) {
+		blog.SeriesPage(w, r, db, st)
+	})
+	mux.HandleFunc("/tags", func(w http.ResponseWriter, r *http.Request) {
+		blog.TagIndexPage(w, r, db, st)
+	})
+	mux.HandleFunc("/tag/", func(w http.ResponseWriter, r *http.Request) {
+		blog.TagPage(w, r, db, st)
+	})
+	mux.HandleFunc("/drafts", func(w http.ResponseWriter, r *http.Request) {
+		blog.DraftsPage(w, r, db, st)
+	})
+	mux.HandleFunc("/feed", func(w http.ResponseWriter, r *http.Request) {
+		blog.FeedHandler(w, r, db, st)
+	})
+
+	//
+	// Functions (htmx requests etc)
+	//
+	mux.HandleFunc("/upload-page", func(w http.ResponseWriter, r *http.Request) {
+		blog.UploadHandler(w, r, db, st, ms, q)
+	})
+	mux.HandleFunc("/delete", func(w http.ResponseWriter, r *http.Request) {
+		blog.DeletePageHandler(w, r, db, st)
+	})
+	mux.HandleFunc("/modify-page", func(w http.ResponseWriter, r *http.Request) {
+		blog.EditPageHandler(w, r, db, st, ms, q)
+	})
+	mux.HandleFunc("/restore-revision", func(w http.ResponseWriter, r *http.Request) {
+		blog.RestoreRevisionHandler(w, r, db, st)
+	})
+	mux.HandleFunc("/autosave", func(w http.ResponseWriter, r *http.Request) {
+		blog.AutosaveHandler(w, r, db, st)
+	})
+	mux.HandleFunc("/discard-draft", func(w http.ResponseWriter, r *http.Request) {
+		blog.DiscardDraftHandler(w, r, db, st)
+	})
+	mux.HandleFunc("/request-account", func(w http.ResponseWriter, r *http.Request) {
+		users.NewUserAccountRequestHandler(w, r, db, st)
+	})
+	mux.HandleFunc("/request-login", func(w http.ResponseWriter, r *http.Request) {
+		users.RequestLogin(w, r, db, st)
+	})
+	mux.HandleFunc("/request-logout", func(w http.ResponseWriter, r *http.Request) {
+		users.RequestLogout(w, r, db, st)
+	})
+	mux.HandleFunc("/request-authenticate/", func(w http.ResponseWriter, r *http.Request) {
+		users.RequestAuthentication(w, r, st)
+	})
+	mux.HandleFunc("/delete-user", func(w http.ResponseWriter, r *http.Request) {
+		users.DeleteUserHandler(w, r, db, st)
+	})
+	mux.HandleFunc("/toggle-admin", func(w http.ResponseWriter, r *http.Request) {
+		users.ToggleAdmin(w, r, db, st)
+	})
+	mux.HandleFunc("/toggle-uploader", func(w http.ResponseWriter, r *http.Request) {
+		users.ToggleUploader(w, r, db, st)
+	})
+	mux.HandleFunc("/toggle-subscription", func(w http.ResponseWriter, r *http.Request) {
+		users.ToggleSubscription(w, r, db, st)
+	})
+	mux.HandleFunc("/add-series", func(w http.ResponseWriter, r *http.Request) {
+		blog.AddSeriesHandler(w, r, db, st)
+	})
+	mux.HandleFunc("/edit-series", func(w http.ResponseWriter, r *http.Request) {
+		blog.EditSeriesHandler(w, r, db, st)
+	})
+	mux.HandleFunc("/delete-series", func(w http.ResponseWriter, r *http.Request) {
+		blog.DeleteSeriesHandler(w, r, db, st)
+	})
+	mux.HandleFunc("/move-series-page", func(w http.ResponseWriter, r *http.Request) {
+		blog.MoveSeriesPageHandler(w, r, db, st)
+	})
+	mux.HandleFunc("/remove-series-page", func(w http.ResponseWriter, r *http.Request) {
+		blog.RemoveSeriesPageHandler(w, r, db, st)
+	})
+	mux.HandleFunc("/rename-tag", func(w http.ResponseWriter, r *http.Request) {
+		blog.RenameTagHandler(w, r, db, st)
+	})
+	mux.HandleFunc("/merge-tag", func(w http.ResponseWriter, r *http.Request) {
+		blog.MergeTagHandler(w, r, db, st)
+	})
+	mux.HandleFunc("/describe-tag", func(w http.ResponseWriter, r *http.Request) {
+		blog.DescribeTagHandler(w, r, db, st)
+	})
+	mux.HandleFunc("/set-tag-parent", func(w http.ResponseWriter, r *http.Request) {
+		blog.SetTagParentHandler(w, r, db, st)
+	})
+	mux.HandleFunc("/add-tag-alias", func(w http.ResponseWriter, r *http.Request) {
+		blog.AddTagAliasHandler(w, r, db, st)
+	})
+	mux.HandleFunc("/remove-tag-alias", func(w http.ResponseWriter, r *http.Request) {
+		blog.RemoveTagAliasHandler(w, r, db, st)
+	})
+	mux.HandleFunc("/add-level", func(w http.ResponseWriter, r *http.Request) {
+		users.AddSubscriptionLevelHandler(w, r, db, st)
+	})
+	mux.HandleFunc("/regenerate-thumbnails", func(w http.ResponseWriter, r *http.Request) {
+		blog.RegenerateThumbnailsHandler(w, r, db, st, q)
+	})
+	mux.HandleFunc("/job-status", func(w http.ResponseWriter, r *http.Request) {
+		jobs.StatusHandler(w, r, q, st)
+	})
+	mux.HandleFunc("/add-comment", func(w http.ResponseWriter, r *http.Request) {
+		blog.AddCommentHandler(w, r, db, st)
+	})
+
+	// serve static files (deps/images)
+	fileServer := http.FileServer(http.Dir("."))
+	mux.Handle("/dep/", fileServer)
+	mux.Handle("/images/", fileServer)
+	mux.Handle("/games/", fileServer)
+	mux.HandleFunc("/media/", func(w http.ResponseWriter, r *http.Request) {
+		media.ServeMedia(w, r, ms)
+	})
+	mux.HandleFunc("/favicon.ico", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	srv := &http.Server{
+		Addr:    ":8080",
+		Handler: mux,
+	}
+
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatalf("listen: %s\n", err)
+		}
+	}()
+
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	<-quit
 	log.Println("Shutting down server...")
 
 	// timeout set here
@@ -497,5 +1591,14 @@ func main() {
 		log.Fatal("Server forced to shut down: ", err)
 	}
 
+	// let queued jobs finish, anything left over runs on the next start
+	log.Println("Draining job queue...")
+	jobs_ctx, jobs_cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer jobs_cancel()
+
+	if err := q.Shutdown(jobs_ctx); err != nil {
+		log.Printf("Job queue did not drain, unfinished jobs will resume on next start: %v", err)
+	}
+
 	log.Println("Server exiting")
 }
@@ -0,0 +1,116 @@
+package main
+
+import (
+	// golang
+	"database/sql"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// the tables the 1.17 -> 1.20 migrations touch, as they were at 1.17
+const schema_1_17 = `
+	CREATE TABLE db_version (version TEXT NOT NULL);
+	INSERT INTO db_version (version) VALUES ('1.17');
+
+	CREATE TABLE pages (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	title TEXT NOT NULL UNIQUE
+	);
+
+	CREATE TABLE users (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	username TEXT NOT NULL UNIQUE,
+	email TEXT NOT NULL,
+	hash TEXT NOT NULL,
+	admin BOOL NOT NULL DEFAULT 0,
+	uploader BOOL NOT NULL DEFAULT 0,
+	created DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	last_login DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE TABLE tags (
+	id INTEGER PRIMARY KEY,
+	name TEXT UNIQUE NOT NULL,
+	description TEXT NOT NULL DEFAULT ''
+	);
+
+	CREATE TABLE page_tags (
+	page_id INTEGER NOT NULL,
+	tag_id INTEGER NOT NULL,
+	FOREIGN KEY (page_id) REFERENCES pages(id) ON DELETE CASCADE ON UPDATE CASCADE,
+	FOREIGN KEY (tag_id) REFERENCES tags(id) ON DELETE CASCADE ON UPDATE CASCADE,
+	PRIMARY KEY (page_id, tag_id)
+	);
+` + tag_aliases_query + `
+
+	INSERT INTO pages (id, title) VALUES (1, 'first'), (2, 'second');
+	INSERT INTO users (username, email, hash) VALUES ('reader', '', '');
+	INSERT INTO tags (id, name, description) VALUES
+		(1, 'GameDev', 'making games'), (2, 'gamedev', ''), (3, 'c++', ''), (4, '🎮', ''), (5, 'unused', '');
+	INSERT INTO page_tags (page_id, tag_id) VALUES (1, 1), (2, 2), (2, 3), (1, 4);
+	INSERT INTO tag_aliases (alias, tag_id) VALUES ('Game-Dev', 1);
+`
+
+func TestUpgradeFrom_1_17(t *testing.T) {
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "blog.db")+DatabaseOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	_, err = db.Exec(schema_1_17)
+	if err != nil {
+		t.Fatalf("creating 1.17 schema: %v", err)
+	}
+
+	// none of the migrations from 1.17 on use the media store
+	err = check_database_version(db, nil)
+	if err != nil {
+		t.Fatalf("migrating from 1.17: %v", err)
+	}
+
+	version, err := getCurrentDBVersion(db)
+	if err != nil || version != DatabaseVersion {
+		t.Fatalf("version after migrating = %q, %v, want %q", version, err, DatabaseVersion)
+	}
+
+	// tags normalized and merged, the one with nothing left and the unused one removed
+	rows, err := db.Query(`
+		SELECT t.name, t.description, IFNULL(t.parent_id, 0), COUNT(pt.page_id)
+		FROM tags t LEFT JOIN page_tags pt ON pt.tag_id = t.id
+		GROUP BY t.id ORDER BY t.name`)
+	if err != nil {
+		t.Fatalf("reading migrated tags: %v", err)
+	}
+	type tag struct {
+		name, description string
+		parent, pages     int64
+	}
+	var got []tag
+	for rows.Next() {
+		var tg tag
+		if err := rows.Scan(&tg.name, &tg.description, &tg.parent, &tg.pages); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, tg)
+	}
+	rows.Close()
+
+	want := []tag{{"c", "", 0, 1}, {"gamedev", "making games", 0, 2}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("tags after migrating = %+v, want %+v", got, want)
+	}
+
+	var alias string
+	err = db.QueryRow("SELECT a.alias FROM tag_aliases a JOIN tags t ON t.id = a.tag_id WHERE t.name = 'gamedev'").Scan(&alias)
+	if err != nil || alias != "game-dev" {
+		t.Errorf("alias after migrating = %q, %v, want game-dev", alias, err)
+	}
+
+	var token string
+	err = db.QueryRow("SELECT feed_token FROM users WHERE username = 'reader'").Scan(&token)
+	if err != nil || token != "" {
+		t.Errorf("feed token after migrating = %q, %v, want an empty token", token, err)
+	}
+}